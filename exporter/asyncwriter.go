@@ -0,0 +1,174 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// AsyncWriter is a writer buffering the written points in memory and
+// writing them using the underlying writer in a background goroutine,
+// when the number of buffered points reaches the maximum or when the
+// flush interval elapses.
+//
+// Writes to the AsyncWriter only fail after it is closed, or when the
+// points of the written batch cannot be buffered, e.g. because of an
+// invalid precision. Errors of the underlying writer are logged, and
+// the first one is returned by Close.
+type AsyncWriter struct {
+	writer    Writer
+	maxPoints int
+	logger    Logger
+
+	flushc chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	batches  map[batchConfig]client.BatchPoints
+	n        int
+	closed   bool
+	firstErr error
+}
+
+// batchConfig identifies the batches of points that can be written in
+// a single request.
+type batchConfig struct {
+	database         string
+	retentionPolicy  string
+	precision        string
+	writeConsistency string
+}
+
+// NewAsyncWriter returns an AsyncWriter writing the points using the
+// writer when maxPoints points are buffered and every interval, if
+// positive. If the clock is nil, the wall clock is used. The errors of
+// the writer are logged using the logger, or the standard logger if
+// nil.
+func NewAsyncWriter(writer Writer, maxPoints int, interval time.Duration, clk clock.Clock, logger Logger) *AsyncWriter {
+	if clk == nil {
+		clk = clock.WallClock
+	}
+	w := &AsyncWriter{
+		writer:    writer,
+		maxPoints: maxPoints,
+		logger:    logger,
+		flushc:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		batches:   make(map[batchConfig]client.BatchPoints),
+	}
+	w.wg.Add(1)
+	go w.loop(clk, interval)
+	return w
+}
+
+func (w *AsyncWriter) loop(clk clock.Clock, interval time.Duration) {
+	defer w.wg.Done()
+	for {
+		// without an interval, the points are only written when
+		// maxPoints are buffered.
+		var tick <-chan time.Time
+		if interval > 0 {
+			tick = clk.After(interval)
+		}
+		select {
+		case <-tick:
+		case <-w.flushc:
+		case <-w.done:
+			w.flush()
+			return
+		}
+		w.flush()
+	}
+}
+
+// Write implements Writer. The points are buffered until the next
+// flush.
+func (w *AsyncWriter) Write(bp client.BatchPoints) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.New("async writer closed")
+	}
+	config := batchConfig{
+		database:         bp.Database(),
+		retentionPolicy:  bp.RetentionPolicy(),
+		precision:        bp.Precision(),
+		writeConsistency: bp.WriteConsistency(),
+	}
+	batch, ok := w.batches[config]
+	if !ok {
+		var err error
+		batch, err = client.NewBatchPoints(client.BatchPointsConfig{
+			Database:         config.database,
+			RetentionPolicy:  config.retentionPolicy,
+			Precision:        config.precision,
+			WriteConsistency: config.writeConsistency,
+		})
+		if err != nil {
+			return errors.Annotate(err, "failed to create a batch of points")
+		}
+		w.batches[config] = batch
+	}
+	batch.AddPoints(bp.Points())
+	w.n += len(bp.Points())
+	if w.maxPoints > 0 && w.n >= w.maxPoints {
+		select {
+		case w.flushc <- struct{}{}:
+		default:
+			// a flush is already pending
+		}
+	}
+	return nil
+}
+
+// flush writes the buffered points using the underlying writer.
+func (w *AsyncWriter) flush() {
+	w.mu.Lock()
+	batches := w.batches
+	w.batches = make(map[batchConfig]client.BatchPoints)
+	w.n = 0
+	w.mu.Unlock()
+	for _, batch := range batches {
+		if err := w.writer.Write(batch); err != nil {
+			w.logf("failed to write %d buffered points: %v", len(batch.Points()), err)
+			w.mu.Lock()
+			if w.firstErr == nil {
+				w.firstErr = errors.Trace(err)
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *AsyncWriter) logf(format string, args ...interface{}) {
+	if w.logger != nil {
+		w.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Close writes the remaining buffered points and stops the background
+// goroutine. It returns the first error of the underlying writer.
+func (w *AsyncWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+	close(w.done)
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.firstErr
+}
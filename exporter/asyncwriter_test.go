@@ -0,0 +1,107 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/clock/testclock"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+// numberBatch returns a batch of n points of the number topic.
+func numberBatch(t *testing.T, n int) client.BatchPoints {
+	t.Helper()
+	bp, err := newExporter(t).BuildPoints(numberConfig, numberEntries(n), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bp
+}
+
+// waitPoints waits until the writer recorded n points.
+func waitPoints(t *testing.T, w *fakeWriter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.Points()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d points, expected %d", len(w.Points()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAsyncWriterInterval(t *testing.T) {
+	clk := testclock.NewClock(epoch)
+	w := &fakeWriter{}
+	aw := exporter.NewAsyncWriter(w, 0, time.Second, clk, testLogger{t})
+	defer aw.Close()
+	if err := aw.Write(numberBatch(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Write(numberBatch(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Points()); n != 0 {
+		t.Errorf("got %d points written before the interval", n)
+	}
+	if err := clk.WaitAdvance(time.Second, 5*time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	// the buffered batches are written in a single request.
+	waitPoints(t, w, 3)
+	if n := len(w.BatchPoints()); n != 1 {
+		t.Errorf("got %d writes, expected 1", n)
+	}
+}
+
+func TestAsyncWriterMaxPoints(t *testing.T) {
+	w := &fakeWriter{}
+	aw := exporter.NewAsyncWriter(w, 3, 0, testclock.NewClock(epoch), testLogger{t})
+	defer aw.Close()
+	if err := aw.Write(numberBatch(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Write(numberBatch(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitPoints(t, w, 3)
+}
+
+func TestAsyncWriterClose(t *testing.T) {
+	w := &fakeWriter{}
+	aw := exporter.NewAsyncWriter(w, 0, 0, testclock.NewClock(epoch), testLogger{t})
+	if err := aw.Write(numberBatch(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "cpu a=1 1000000000", "cpu a=2 1000000000")
+	if err := aw.Write(numberBatch(t, 1)); err == nil || !strings.Contains(err.Error(), "async writer closed") {
+		t.Errorf("got %v, expected a closed writer error", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Errorf("got %v closing the writer twice", err)
+	}
+}
+
+func TestAsyncWriterError(t *testing.T) {
+	w := &fakeWriter{errs: []error{errors.New("connection refused")}}
+	logger := &logRecorder{}
+	aw := exporter.NewAsyncWriter(w, 0, 0, testclock.NewClock(epoch), logger)
+	if err := aw.Write(numberBatch(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("got %v, expected the write error", err)
+	}
+	if !logger.contains("failed to write 1 buffered points: connection refused") {
+		t.Errorf("write error not logged: %q", logger.msgs)
+	}
+}
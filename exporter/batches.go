@@ -0,0 +1,81 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch holds the data consumed from a kafka topic, processed by
+// ProcessBatches.
+type Batch struct {
+	Config     TopicConfig
+	Data       [][]byte
+	Timestamps []time.Time
+}
+
+// BatchErrors is returned by ProcessBatches when some of the batches
+// could not be processed. It maps batch indexes to the errors returned
+// by ProcessData.
+type BatchErrors map[int]error
+
+// Error implements the error interface.
+func (e BatchErrors) Error() string {
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	msgs := make([]string, len(indexes))
+	for i, index := range indexes {
+		msgs[i] = fmt.Sprintf("batch %d: %v", index, e[index])
+	}
+	return fmt.Sprintf("failed to process %d batches: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ProcessBatches processes the batches concurrently, using at most the
+// given number of workers, each calling ProcessData for one batch at a
+// time. If workers is not positive, a single worker is used.
+//
+// The writer is used concurrently by the workers and must be safe for
+// concurrent use, as the influxdb v1 client.Client is.
+func (e *Exporter) ProcessBatches(ctx context.Context, writer Writer, batches []Batch, workers int) error {
+	if workers <= 0 {
+		workers = 1
+	}
+	indexes := make(chan int)
+	var mu sync.Mutex
+	batchErrors := make(BatchErrors)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				batch := batches[index]
+				err := e.ProcessData(ctx, batch.Config, writer, batch.Data, batch.Timestamps)
+				if err != nil {
+					mu.Lock()
+					batchErrors[index] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range batches {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if len(batchErrors) > 0 {
+		return batchErrors
+	}
+	return nil
+}
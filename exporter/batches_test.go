@@ -0,0 +1,46 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+	"github.com/cloud-green/metamorphosis/exporter/exportertest"
+)
+
+func TestProcessBatches(t *testing.T) {
+	var batches []exporter.Batch
+	var expected []string
+	for i := 0; i < 8; i++ {
+		topic := fmt.Sprintf("topic-%d", i)
+		batches = append(batches, exporter.Batch{
+			Config: exporter.TopicConfig{
+				Topic:  topic,
+				Fields: map[string]string{"a": "number"},
+			},
+			Data:       entries(`{"a": 1}`, `{"a": 2}`),
+			Timestamps: []time.Time{epoch},
+		})
+		expected = append(expected, topic+" a=1 1000000000", topic+" a=2 1000000000")
+	}
+	batches[5].Data = entries(`{"a": 1}`, `{`)
+	expected = append(expected[:11], expected[12:]...)
+
+	w := &exportertest.RecordingWriter{}
+	err := newExporter(t).ProcessBatches(context.Background(), w, batches, 3)
+	batchErrors, ok := err.(exporter.BatchErrors)
+	if !ok {
+		t.Fatalf("got %v, expected BatchErrors", err)
+	}
+	if len(batchErrors) != 1 || batchErrors[5] == nil {
+		t.Errorf("got %v, expected the error of batch 5 only", batchErrors)
+	}
+	got := lines(w.Points())
+	sort.Strings(got)
+	assertLines(t, got, expected...)
+}
@@ -0,0 +1,342 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+// The exporter command consumes the entries of kafka topics and writes
+// them as points to influxdb, as specified by the config file.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v1"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+const maxBackoff = time.Minute * 5
+
+var (
+	kafkaBrokers = os.Getenv("KAFKA_BROKERS")
+	influxAPI    = os.Getenv("INFLUX_API")
+	configFile   = os.Getenv("CONFIG")
+)
+
+type Config struct {
+	KafkaBrokers string                 `yaml:"kafka-brokers,omitempty"`
+	KafkaTLS     *tlsConfig             `yaml:"kafka-tls,omitempty"`
+	InfluxDB     string                 `yaml:"influx-db,omitempty"`
+	Topics       []exporter.TopicConfig `yaml:"topics"`
+
+	// InfluxDB2, if set, specifies an InfluxDB 2.x server the points
+	// are written to instead of the influx-db server.
+	InfluxDB2 *exporter.InfluxDB2Config `yaml:"influx-db2,omitempty"`
+	// PrometheusRemoteWrite, if set, specifies a Prometheus
+	// remote-write endpoint the points are written to instead of
+	// influxdb.
+	PrometheusRemoteWrite *exporter.PrometheusConfig `yaml:"prometheus-remote-write,omitempty"`
+	// OutputFile, if set, holds the path of a file the points of the
+	// topics not specifying an endpoint are appended to in line
+	// protocol, instead of being written to influxdb, for running the
+	// exporter without a server.
+	OutputFile string `yaml:"output-file,omitempty"`
+	// BatchSize holds the maximum number of points written to
+	// influxdb in a single request.
+	BatchSize int `yaml:"batch-size,omitempty"`
+	// Retry specifies how failed influxdb writes are retried.
+	Retry exporter.RetryConfig `yaml:"retry,omitempty"`
+	// DryRun specifies that points are logged rather than written
+	// to influxdb.
+	DryRun bool `yaml:"dry-run,omitempty"`
+	// MeasurementPrefix and MeasurementSuffix hold the strings
+	// prepended and appended to the names of all measurements, e.g.
+	// to tell apart the environments sharing an influxdb.
+	MeasurementPrefix string `yaml:"measurement-prefix,omitempty"`
+	MeasurementSuffix string `yaml:"measurement-suffix,omitempty"`
+	// PointsPerSecond, if set, holds the maximum rate at which points
+	// are written, across all topics.
+	PointsPerSecond float64 `yaml:"points-per-second,omitempty"`
+}
+
+type tlsConfig struct {
+	CACert string `yaml:"ca-cert"`
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+}
+
+func (c *Config) kafkaBrokers() string {
+	if c.KafkaBrokers != "" {
+		return c.KafkaBrokers
+	}
+	return kafkaBrokers
+}
+
+func (c *Config) tls() (*exporter.TLSConfig, error) {
+	if c.KafkaTLS == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.KafkaTLS.Cert, c.KafkaTLS.Key)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to load client certificate and key")
+	}
+	caCertBytes, err := ioutil.ReadFile(c.KafkaTLS.CACert)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to read CA certificate")
+	}
+	pemData, _ := pem.Decode(caCertBytes)
+	if pemData == nil {
+		return nil, errors.New("failed to decode CA certificate")
+	}
+	caCert, err := x509.ParseCertificate(pemData.Bytes)
+	if err != nil {
+		return nil, errors.Annotate(err, "invalid CA certificate")
+	}
+	return &exporter.TLSConfig{
+		Certificate:   cert,
+		CACertificate: caCert,
+	}, nil
+}
+
+func (c *Config) influxDB() (*client.HTTPConfig, error) {
+	influxDBConnectionString := influxAPI
+	if c.InfluxDB != "" {
+		influxDBConnectionString = c.InfluxDB
+	}
+	return exporter.ParseInfluxDB(influxDBConnectionString)
+}
+
+func main() {
+	log.Println("starting exporter")
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		log.Fatalf("failed to read the config file: %v", err)
+	}
+	var config Config
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		log.Fatalf("failed to unmarshal the config file: %v", err)
+	}
+	if err := exporter.ValidateConfigs(config.Topics); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	tlsConfig, err := config.tls()
+	if err != nil {
+		log.Fatalf("invalid TLS configuration: %v", err)
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	clients, err := newClientFactory(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if closer, ok := clients.Default.(io.Closer); ok {
+		defer closer.Close()
+	}
+	defer clients.Close()
+
+	exp := &exporter.Exporter{
+		BatchSize: config.BatchSize,
+		Retry:     config.Retry,
+		DryRun:    config.DryRun,
+
+		MeasurementPrefix: config.MeasurementPrefix,
+		MeasurementSuffix: config.MeasurementSuffix,
+		PointsPerSecond:   config.PointsPerSecond,
+	}
+
+	consumers := make([]*exporter.Consumer, 0)
+	go func() {
+		tries := 0
+		nextTime := (time.Duration(math.Exp2(float64(tries))) * time.Millisecond) + time.Duration(rand.Intn(100))
+		timer := time.NewTimer(nextTime)
+		topics := config.Topics
+
+		for len(topics) > 0 {
+			var tmpTopics []exporter.TopicConfig
+
+			for _, topicConfig := range topics {
+				writer, err := clients.Writer(topicConfig.Endpoint)
+				if err != nil {
+					log.Printf("failed to create influxdb client for topic: %s: %v", topicConfig.Topic, err)
+					tmpTopics = append(tmpTopics, topicConfig)
+					continue
+				}
+				consumer, err := startConsumer(ctx, config.kafkaBrokers(), tlsConfig, exp, writer, topicConfig, groupName(config.Topics, topicConfig))
+				if err != nil {
+					log.Printf("failed to start consumer with topic: %s: %v", topicConfig.Topic, err)
+					tmpTopics = append(tmpTopics, topicConfig)
+				} else {
+					consumers = append(consumers, consumer)
+				}
+			}
+			topics = tmpTopics
+
+			tries++
+			nextTime = (time.Duration(math.Exp2(float64(tries))) * time.Millisecond) + time.Duration(rand.Intn(100))
+			if nextTime > maxBackoff {
+				log.Printf("next timer %+v surpasses the max backoff time of %+v, setting to max backoff time\n", nextTime.String(), maxBackoff.String())
+				nextTime = maxBackoff
+			}
+
+			timer = time.NewTimer(nextTime)
+			var failingTopics []string
+			for _, topic := range topics {
+				failingTopics = append(failingTopics, topic.Topic)
+			}
+			log.Printf("scheduling next retry: %+v, tries: %d, topics failing: %+v\n", nextTime.String(), tries+1, failingTopics)
+
+			select {
+			case <-ctx.Done():
+				log.Println("context canceled, exiting backoff")
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+
+	defer func() {
+		for _, consumer := range consumers {
+			err := consumer.Close()
+			if err != nil {
+				log.Printf("failed to stop consumer for topic %q: %v", consumer.Topic, err)
+				continue
+			}
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+
+	select {
+	case <-c:
+		log.Println("got interrupt")
+		return
+	}
+}
+
+// newClientFactory returns the factory of the writers used for the
+// topics of the config. The databases of the topics are created on the
+// influxdb servers, except in dry run mode, where no server is connected
+// and the points are discarded once logged.
+func newClientFactory(config *Config) (*exporter.ClientFactory, error) {
+	if config.DryRun {
+		return &exporter.ClientFactory{
+			Default: exporter.DiscardWriter,
+			New: func(endpoint string) (exporter.Writer, error) {
+				return exporter.DiscardWriter, nil
+			},
+		}, nil
+	}
+	var defaultWriter exporter.Writer
+	var err error
+	if config.OutputFile != "" {
+		defaultWriter = exporter.FileWriter(config.OutputFile)
+	} else if config.PrometheusRemoteWrite != nil {
+		defaultWriter, err = exporter.NewPrometheusWriter(*config.PrometheusRemoteWrite)
+		if err != nil {
+			return nil, errors.Annotate(err, "invalid prometheus remote-write configuration")
+		}
+	} else if config.InfluxDB2 != nil {
+		defaultWriter, err = exporter.NewInfluxDB2Writer(*config.InfluxDB2)
+		if err != nil {
+			return nil, errors.Annotate(err, "invalid influxdb 2.x configuration")
+		}
+	} else {
+		clientCfg, err := config.influxDB()
+		if err != nil {
+			return nil, errors.Annotate(err, "invalid influxdb connection string")
+		}
+		httpClient, err := exporter.NewInfluxDBClient(*clientCfg)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to create http client")
+		}
+		if err := exporter.CreateDatabases(httpClient, config.Topics, ""); err != nil {
+			httpClient.Close()
+			return nil, errors.Annotate(err, "failed to create database")
+		}
+		defaultWriter = httpClient
+	}
+	return &exporter.ClientFactory{
+		Default: defaultWriter,
+		New: func(endpoint string) (exporter.Writer, error) {
+			clientCfg, err := exporter.ParseInfluxDB(endpoint)
+			if err != nil {
+				return nil, errors.Annotate(err, "invalid influxdb connection string")
+			}
+			influxClient, err := exporter.NewInfluxDBClient(*clientCfg)
+			if err != nil {
+				return nil, errors.Annotate(err, "failed to create http client")
+			}
+			if err := exporter.CreateDatabases(influxClient, config.Topics, endpoint); err != nil {
+				influxClient.Close()
+				return nil, errors.Trace(err)
+			}
+			return influxClient, nil
+		},
+	}, nil
+}
+
+// groupName returns the name of the consumer group of the topic config.
+// A topic written to several measurements is consumed by a group per
+// measurement, so that each of its configs processes all the messages.
+func groupName(configs []exporter.TopicConfig, config exporter.TopicConfig) string {
+	n := 0
+	for _, c := range configs {
+		if c.Topic == config.Topic {
+			n++
+		}
+	}
+	if n < 2 {
+		return "influx-consumer"
+	}
+	measurement := config.Measurement
+	if measurement == "" {
+		measurement = config.Topic
+	}
+	return "influx-consumer-" + measurement
+}
+
+func startConsumer(ctx context.Context, kafkaBrokers string, tlsConfig *exporter.TLSConfig, exp *exporter.Exporter, writer exporter.Writer, config exporter.TopicConfig, groupName string) (*exporter.Consumer, error) {
+	consumerConfig := exporter.ConsumerConfig{
+		Context:          ctx,
+		Brokers:          strings.Split(kafkaBrokers, ","),
+		TLSConfig:        tlsConfig,
+		Topic:            config.Topic,
+		GroupName:        groupName,
+		Clock:            clock.WallClock,
+		ConsumePeriod:    time.Minute,
+		StartWaitTime:    30 * time.Second,
+		MaximumCacheSize: 10000,
+		Consume: func(ctx context.Context, keys [][]byte, headers []map[string][]byte, data [][]byte, timestamps []time.Time) error {
+			err := exp.ProcessDataWithHeaders(ctx, config, writer, keys, headers, data, timestamps)
+			if _, ok := err.(exporter.ProcessErrors); ok {
+				// entries that could not be processed are logged
+				// and dropped.
+				return nil
+			}
+			return err
+		},
+	}
+
+	consumer, err := exporter.NewConsumer(consumerConfig)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return consumer, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+// queryRecorder is an influxdb server recording the queries it gets.
+type queryRecorder struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *queryRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.queries = append(r.queries, req.FormValue("q"))
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"results":[{}]}`))
+}
+
+func (r *queryRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+func TestNewClientFactoryCreatesDatabases(t *testing.T) {
+	rec := &queryRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	config := &Config{
+		InfluxDB: srv.URL,
+		Topics:   []exporter.TopicConfig{{Topic: "cpu", Database: "metrics"}},
+	}
+	clients, err := newClientFactory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients.Close()
+	if rec.count() == 0 {
+		t.Error("no database was created")
+	}
+}
+
+func TestNewClientFactoryDryRun(t *testing.T) {
+	rec := &queryRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	config := &Config{
+		InfluxDB: srv.URL,
+		Topics: []exporter.TopicConfig{
+			{Topic: "cpu"},
+			{Topic: "mem", Endpoint: srv.URL},
+		},
+		DryRun: true,
+	}
+	clients, err := newClientFactory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients.Close()
+	for _, endpoint := range []string{"", srv.URL} {
+		if _, err := clients.Writer(endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := rec.count(); n != 0 {
+		t.Errorf("got %d queries in dry run mode: %q", n, rec.queries)
+	}
+}
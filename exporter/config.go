@@ -0,0 +1,187 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envVarPattern matches the references to environment variables in
+// config strings, e.g. "${INFLUX_ENDPOINT}".
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadConfig reads the YAML lists of topic configs from the reader. The
+// reader may hold several YAML documents separated by "---", each
+// holding a list of topic configs, and may be gzip compressed. The
+// references to environment variables in string values, e.g.
+// "${INFLUX_ENDPOINT}", are replaced with the variable values, or with
+// empty strings if the variables are not set. Unknown keys and topics
+// configured more than once, even in different documents, are rejected.
+func LoadConfig(r io.Reader) ([]TopicConfig, error) {
+	r, closer, err := decompressConfig(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer closer.Close()
+	decoder := yaml.NewDecoder(r)
+	decoder.SetStrict(true)
+	var configs []TopicConfig
+	for {
+		var docConfigs []TopicConfig
+		err := decoder.Decode(&docConfigs)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to parse the config")
+		}
+		configs = append(configs, docConfigs...)
+	}
+	topics := make(map[string]bool, len(configs))
+	for i := range configs {
+		interpolate(reflect.ValueOf(&configs[i]).Elem())
+		if topics[configs[i].Topic] {
+			return nil, errors.Errorf("topic %q configured more than once", configs[i].Topic)
+		}
+		topics[configs[i].Topic] = true
+	}
+	return configs, nil
+}
+
+// decompressConfig returns the reader of the config, which decompresses
+// it if it is gzip compressed, and the closer releasing the reader.
+func decompressConfig(r io.Reader) (io.Reader, io.Closer, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, gzipMagic) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, errors.Annotate(err, "failed to decompress the config")
+		}
+		return gr, gr, nil
+	}
+	return br, ioutil.NopCloser(nil), nil
+}
+
+// ValidateConfigs checks the topic configs. Each config must be valid,
+// no two configs may write the same topic to the same measurement, and
+// the configs writing to the same measurement of the same database must
+// not declare fields of conflicting types, which influxdb would reject.
+// "number" and "float" fields are both written as floats, as are
+// "integer" fields of configs specifying CoerceFloat, and "hist" and
+// "top-k" fields are not checked.
+func ValidateConfigs(configs []TopicConfig) error {
+	type fieldDecl struct {
+		topic, fieldType string
+	}
+	fields := make(map[string]fieldDecl)
+	checkFields := func(c *TopicConfig, measurement string, declared map[string]string) error {
+		for key, entryType := range declared {
+			fieldType, _ := parseFieldType(entryType)
+			switch fieldType {
+			case "number":
+				fieldType = "float"
+			case "integer":
+				if c.CoerceFloat {
+					fieldType = "float"
+				}
+			case "hist", "top-k":
+				continue
+			}
+			name := c.database() + "/" + measurement + "/" + c.FieldPrefix + c.fieldKey(key)
+			decl, ok := fields[name]
+			if !ok {
+				fields[name] = fieldDecl{topic: c.Topic, fieldType: fieldType}
+				continue
+			}
+			if decl.fieldType != fieldType {
+				return errors.Errorf("field %q of measurement %q declared as %s by topic %q and as %s by topic %q", c.FieldPrefix+c.fieldKey(key), measurement, decl.fieldType, decl.topic, fieldType, c.Topic)
+			}
+		}
+		return nil
+	}
+	for i := range configs {
+		c := &configs[i]
+		if err := c.Validate(); err != nil {
+			return errors.Annotatef(err, "invalid configuration of topic %q", c.Topic)
+		}
+		if err := checkFields(c, c.measurement(), c.Fields); err != nil {
+			return errors.Trace(err)
+		}
+		for _, sub := range c.SubMeasurements {
+			if err := checkFields(c, sub.Measurement, sub.Fields); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return errors.Trace(checkDuplicateTopics(configs))
+}
+
+// checkDuplicateTopics checks that no two configs write the same topic
+// to the same measurement. A topic may be written to several
+// measurements.
+func checkDuplicateTopics(configs []TopicConfig) error {
+	type topicMeasurement struct {
+		topic, measurement string
+	}
+	topics := make(map[topicMeasurement]bool, len(configs))
+	for i := range configs {
+		tm := topicMeasurement{topic: configs[i].Topic, measurement: configs[i].measurement()}
+		if topics[tm] {
+			return errors.Errorf("topic %q configured more than once for measurement %q", tm.topic, tm.measurement)
+		}
+		topics[tm] = true
+	}
+	return nil
+}
+
+// gzipMagic holds the first bytes of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// interpolate replaces the references to environment variables in the
+// strings held by the value, which must be settable.
+func interpolate(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(expandEnv(v.String()))
+	case reflect.Ptr:
+		if !v.IsNil() {
+			interpolate(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				interpolate(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			interpolate(v.Index(i))
+		}
+	case reflect.Map:
+		// map values are not addressable, so they are copied,
+		// interpolated and stored back.
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			interpolate(value)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
+
+// expandEnv replaces the references to environment variables in s.
+func expandEnv(s string) string {
+	return envVarPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(envVarPattern.FindStringSubmatch(ref)[1])
+	})
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+func TestValidateConfigs(t *testing.T) {
+	tests := []struct {
+		about   string
+		configs []exporter.TopicConfig
+		err     string
+	}{{
+		about: "valid configs",
+		configs: []exporter.TopicConfig{{
+			Topic:  "cpu",
+			Fields: map[string]string{"a": "number"},
+		}, {
+			Topic:       "cpu-old",
+			Measurement: "cpu",
+			Fields:      map[string]string{"a": "float"},
+		}},
+	}, {
+		about: "topic written to several measurements",
+		configs: []exporter.TopicConfig{{
+			Topic:  "cpu",
+			Fields: map[string]string{"a": "number"},
+		}, {
+			Topic:       "cpu",
+			Measurement: "cpu2",
+			Fields:      map[string]string{"a": "number"},
+		}},
+	}, {
+		about: "duplicate topic and measurement",
+		configs: []exporter.TopicConfig{{
+			Topic:  "cpu",
+			Fields: map[string]string{"a": "number"},
+		}, {
+			Topic:       "cpu",
+			Measurement: "cpu",
+			Fields:      map[string]string{"b": "number"},
+		}},
+		err: `topic "cpu" configured more than once for measurement "cpu"`,
+	}, {
+		about: "conflicting field types",
+		configs: []exporter.TopicConfig{{
+			Topic:  "cpu",
+			Fields: map[string]string{"a": "number"},
+		}, {
+			Topic:       "cpu-old",
+			Measurement: "cpu",
+			Fields:      map[string]string{"a": "string"},
+		}},
+		err: `field "a" of measurement "cpu" declared as float by topic "cpu" and as string by topic "cpu-old"`,
+	}, {
+		about: "integer fields coerced to floats",
+		configs: []exporter.TopicConfig{{
+			Topic:       "cpu",
+			Fields:      map[string]string{"a": "integer"},
+			CoerceFloat: true,
+		}, {
+			Topic:       "cpu-old",
+			Measurement: "cpu",
+			Fields:      map[string]string{"a": "float"},
+		}},
+	}, {
+		about: "integer field conflicting with a coerced one",
+		configs: []exporter.TopicConfig{{
+			Topic:       "cpu",
+			Fields:      map[string]string{"a": "integer"},
+			CoerceFloat: true,
+		}, {
+			Topic:       "cpu-old",
+			Measurement: "cpu",
+			Fields:      map[string]string{"a": "integer"},
+		}},
+		err: `field "a" of measurement "cpu" declared as float by topic "cpu" and as integer by topic "cpu-old"`,
+	}}
+	for _, test := range tests {
+		t.Run(test.about, func(t *testing.T) {
+			err := exporter.ValidateConfigs(test.configs)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	os.Setenv("TEST_INFLUX_ENDPOINT", "http://influx:8086")
+	defer os.Unsetenv("TEST_INFLUX_ENDPOINT")
+	configs, err := exporter.LoadConfig(strings.NewReader(`
+- topic: cpu
+  endpoint: ${TEST_INFLUX_ENDPOINT}
+  database: metrics
+  tags:
+    region: ${TEST_UNSET_REGION}
+  fields:
+    a: number
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("got %d configs, expected 1", len(configs))
+	}
+	config := configs[0]
+	if config.Topic != "cpu" || config.Database != "metrics" || config.Fields["a"] != "number" {
+		t.Errorf("got config %+v", config)
+	}
+	if config.Endpoint != "http://influx:8086" {
+		t.Errorf("got endpoint %q, expected the interpolated variable", config.Endpoint)
+	}
+	if region, ok := config.Tags["region"]; !ok || region != "" {
+		t.Errorf("got region %q, expected an empty string for an unset variable", region)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	_, err := exporter.LoadConfig(strings.NewReader(`
+- topic: cpu
+  feilds:
+    a: number
+`))
+	if err == nil || !strings.Contains(err.Error(), "feilds") {
+		t.Errorf("got %v, expected an unknown key error", err)
+	}
+}
+
+// multiDocConfig holds three YAML documents of topic configs.
+const multiDocConfig = `
+- topic: cpu
+  fields:
+    a: number
+---
+- topic: mem
+  fields:
+    used: number
+- topic: disk
+  fields:
+    free: number
+---
+[]
+`
+
+func TestLoadConfigDocuments(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write([]byte(multiDocConfig)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for about, data := range map[string][]byte{
+		"plain":      []byte(multiDocConfig),
+		"compressed": compressed.Bytes(),
+	} {
+		t.Run(about, func(t *testing.T) {
+			configs, err := exporter.LoadConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var topics []string
+			for _, config := range configs {
+				topics = append(topics, config.Topic)
+			}
+			if strings.Join(topics, " ") != "cpu mem disk" {
+				t.Errorf("got topics %v, expected cpu, mem and disk", topics)
+			}
+		})
+	}
+
+	// a topic configured in several documents is rejected, even
+	// for different measurements.
+	_, err := exporter.LoadConfig(strings.NewReader(multiDocConfig + `
+---
+- topic: mem
+  measurement: mem-total
+  fields:
+    total: number
+`))
+	if err == nil || !strings.Contains(err.Error(), `topic "mem" configured more than once`) {
+		t.Errorf("got %v, expected a duplicate topic error", err)
+	}
+
+	_, err = exporter.LoadConfig(strings.NewReader(multiDocConfig + `
+---
+- topic: mem
+  fields:
+    total: number
+`))
+	if err == nil || !strings.Contains(err.Error(), `topic "mem" configured more than once`) {
+		t.Errorf("got %v, expected a duplicate topic error", err)
+	}
+}
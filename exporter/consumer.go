@@ -1,6 +1,6 @@
 // Copyright 2019 Canonical Ltd.  All rights reserved.
 
-package main
+package exporter
 
 import (
 	"context"
@@ -58,11 +58,28 @@ var (
 )
 
 type consumerMessage struct {
+	key          []byte
+	headers      map[string][]byte
 	payload      []byte
 	timestamp    time.Time
 	consumedFunc func()
 }
 
+// messageHeaders returns the headers of a kafka message keyed by name.
+// If a header is repeated, its last value is returned.
+func messageHeaders(recordHeaders []*sarama.RecordHeader) map[string][]byte {
+	if len(recordHeaders) == 0 {
+		return nil
+	}
+	headers := make(map[string][]byte, len(recordHeaders))
+	for _, header := range recordHeaders {
+		if header != nil {
+			headers[string(header.Key)] = header.Value
+		}
+	}
+	return headers
+}
+
 type consumerClaim struct {
 	id      string
 	session sarama.ConsumerGroupSession
@@ -105,7 +122,7 @@ type ConsumerConfig struct {
 	GroupName        string
 	MaximumCacheSize int
 	Clock            clock.Clock
-	Consume          func(context.Context, [][]byte, []time.Time) error
+	Consume          func(ctx context.Context, keys [][]byte, headers []map[string][]byte, payloads [][]byte, timestamps []time.Time) error
 	ConsumePeriod    time.Duration
 	StartWaitTime    time.Duration
 
@@ -297,6 +314,8 @@ func (c *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim saram
 		c.muMessages.Lock()
 		c.messages = append(c.messages,
 			consumerMessage{
+				key:       msg.Key,
+				headers:   messageHeaders(msg.Headers),
 				payload:   msg.Value,
 				timestamp: msg.Timestamp,
 				consumedFunc: func() {
@@ -347,15 +366,19 @@ func (c *Consumer) consume(ctx context.Context) (interface{}, error) {
 	}
 
 	ackFunctions := []func(){}
+	keys := [][]byte{}
+	headers := []map[string][]byte{}
 	payloads := [][]byte{}
 	timestamps := []time.Time{}
 	for _, message := range messages {
 		ackFunctions = append(ackFunctions, message.consumedFunc)
+		keys = append(keys, message.key)
+		headers = append(headers, message.headers)
 		payloads = append(payloads, message.payload)
 		timestamps = append(timestamps, message.timestamp)
 	}
 	// consume payloads collected in the cache
-	err := c.Consume(ctx, payloads, timestamps)
+	err := c.Consume(ctx, keys, headers, payloads, timestamps)
 	if err != nil {
 		err = c.writeFailed(ctx, payloads)
 		if err != nil {
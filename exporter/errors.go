@@ -0,0 +1,102 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrUnmarshal is the kind of the errors of entries that could
+	// not be unmarshaled.
+	ErrUnmarshal = errors.New("failed to unmarshal a data point")
+	// ErrMissingKey is the kind of the errors of configured keys that
+	// were not found in an entry.
+	ErrMissingKey = errors.New("entry key not found")
+	// ErrFieldTypeMismatch is the kind of the errors of entry values
+	// that could not be converted to their configured type.
+	ErrFieldTypeMismatch = errors.New("field type mismatch")
+)
+
+// EntryError describes a failure to process an entry. Unmarshal errors
+// stop the entry from being written and are returned in ProcessErrors.
+// The other kinds of errors only omit the value of the key they refer
+// to: the entry is still written, and the EntryError is passed to the
+// Logger of the exporter rather than returned.
+//
+// EntryError supports errors.Is with its kind, e.g.
+//
+//	errors.Is(err, ErrUnmarshal)
+//
+// and errors.As, also when err holds the ProcessErrors returned by
+// ProcessData. Both are available from Go 1.13, and do not rely on the
+// multiple error unwrapping of Go 1.20.
+type EntryError struct {
+	// Kind holds the kind of error: ErrUnmarshal, ErrMissingKey or
+	// ErrFieldTypeMismatch.
+	Kind error
+	// Topic holds the topic of the entry.
+	Topic string
+	// Index holds the index of the entry in the processed data.
+	Index int
+	// Key holds the entry key the error refers to, if any.
+	Key string
+	// Err, if set, holds the underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("topic %q entry %d: %s", e.Topic, e.Index, e.detail())
+}
+
+// detail returns the message of the error without the topic and index
+// of the entry.
+func (e *EntryError) detail() string {
+	msg := fmt.Sprint(e.Kind)
+	if e.Key != "" {
+		msg += fmt.Sprintf(": %v", e.Key)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+// Is returns true if the target is the kind of the error.
+func (e *EntryError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error.
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// entryError returns the error of the given kind for the entry being
+// processed.
+func (p *processor) entryError(kind error, key string, err error) *EntryError {
+	return &EntryError{
+		Kind:  kind,
+		Topic: p.Topic,
+		Index: p.index,
+		Key:   key,
+		Err:   err,
+	}
+}
+
+// WriteError is the error of a write rejected by the server. Writes
+// rejected with a 4xx status are not retried.
+type WriteError struct {
+	// StatusCode holds the HTTP status code of the response.
+	StatusCode int
+	// Message holds the error message.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *WriteError) Error() string {
+	return e.Message
+}
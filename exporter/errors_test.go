@@ -0,0 +1,235 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+	"github.com/cloud-green/metamorphosis/exporter/exportertest"
+)
+
+func TestEntryErrors(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "cpu",
+		Fields: map[string]string{
+			"a": "number",
+			"b": "number?",
+		},
+	}
+	logger := &logRecorder{}
+	w, err := processData(t, &exporter.Exporter{Logger: logger}, config,
+		`{"a": 1}`,
+		`{"b": 2}`,
+		`{"a": "x", "b": 3}`,
+		`{`,
+	)
+	// only the entry that could not be written is returned.
+	processErrors, ok := err.(exporter.ProcessErrors)
+	if !ok || len(processErrors) != 1 || processErrors[0].Index != 3 {
+		t.Fatalf("got %v, expected the error of entry 3 only", err)
+	}
+	if !errors.Is(err, exporter.ErrUnmarshal) {
+		t.Errorf("got %v, expected an unmarshal error", err)
+	}
+	var entryError *exporter.EntryError
+	if !errors.As(err, &entryError) || entryError.Index != 3 || entryError.Topic != "cpu" {
+		t.Errorf("got %v, expected the EntryError of entry 3", err)
+	}
+	if msg := err.Error(); msg != "failed to process 1 entries: entry 3: failed to unmarshal a data point: unexpected EOF" {
+		t.Errorf("got error message %q", msg)
+	}
+
+	// the errors of the entries written partially are logged.
+	expected := []struct {
+		index int
+		kind  error
+		key   string
+	}{
+		{1, exporter.ErrMissingKey, "a"},
+		{2, exporter.ErrFieldTypeMismatch, "a"},
+	}
+	if len(logger.errs) != len(expected) {
+		t.Fatalf("got %d logged errors %v, expected %d", len(logger.errs), logger.errs, len(expected))
+	}
+	for i, entryError := range logger.errs {
+		if entryError.Index != expected[i].index {
+			t.Errorf("error %d is of entry %d, expected %d", i, entryError.Index, expected[i].index)
+		}
+		if entryError.Kind != expected[i].kind || entryError.Key != expected[i].key {
+			t.Errorf("error %d is %v, expected %v of key %q", i, entryError, expected[i].kind, expected[i].key)
+		}
+		if entryError.Topic != "cpu" {
+			t.Errorf("error %d is of topic %q", i, entryError.Topic)
+		}
+	}
+	// the entries with missing keys and invalid values are still
+	// written, without the corresponding fields.
+	assertLines(t, lines(w.Points()),
+		"cpu a=1 1000000000",
+		"cpu b=2 1000000000",
+		"cpu b=3 1000000000",
+	)
+}
+
+func TestPartialEntryErrors(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "t",
+		Fields:    map[string]string{"a": "number", "b": "number", "c": "number"},
+		Heartbeat: "heartbeat",
+	}
+	// an entry written without some of its keys is not an error of
+	// the call.
+	w, err := processData(t, newExporter(t), config, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heartbeats := w.Find(exportertest.PointMatcher{
+		Measurement: "heartbeat",
+		Fields:      map[string]interface{}{"errors": int64(0)},
+	})
+	if len(heartbeats) != 1 {
+		t.Errorf("got %d heartbeat points without errors, expected 1", len(heartbeats))
+	}
+
+	// the errors of the entries of an array are grouped by entry.
+	config.Heartbeat = ""
+	config.ArrayPayload = true
+	_, err = processData(t, newExporter(t), config, `[{"x": 1}, {"y": 2}]`, `[{"a": 1}]`)
+	processErrors, ok := err.(exporter.ProcessErrors)
+	if !ok || len(processErrors) != 2 {
+		t.Fatalf("got %v, expected the errors of the two array entries", err)
+	}
+	if msg := err.Error(); msg != "failed to process 1 entries: entry 0: failed to create a new data point: point without fields is unsupported, failed to create a new data point: point without fields is unsupported" {
+		t.Errorf("got error message %q", msg)
+	}
+}
+
+func TestProcessErrors(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	w, err := processData(t, newExporter(t), config, `{"a": 1}`, `{"a": 2`)
+	processErrors, ok := err.(exporter.ProcessErrors)
+	if !ok {
+		t.Fatalf("got %v, expected ProcessErrors", err)
+	}
+	if len(processErrors) != 1 || processErrors[0].Index != 1 {
+		t.Fatalf("got %v, expected the error of entry 1 only", processErrors)
+	}
+	if string(processErrors[0].Data) != `{"a": 2` {
+		t.Errorf("got data %q of the failed entry", processErrors[0].Data)
+	}
+	assertLines(t, lines(w.Points()), "cpu a=1 1000000000")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	logger := &logRecorder{}
+	e := &exporter.Exporter{Logger: logger}
+	// the random function is called while creating the points of each
+	// entry, and panics for the second one.
+	calls := 0
+	e.Rand = func() float64 {
+		calls++
+		if calls == 2 {
+			var entry map[string]interface{}
+			return entry["rate"].(float64)
+		}
+		return 0
+	}
+	config := exporter.TopicConfig{
+		Topic:           "cpu",
+		Fields:          map[string]string{"a": "number"},
+		TraceTagField:   "trace",
+		TraceSampleRate: 1,
+	}
+	w, err := processData(t, e, config,
+		`{"a": 1, "trace": "x"}`,
+		`{"a": 2, "trace": "y"}`,
+		`{"a": 3, "trace": "z"}`,
+	)
+	processErrors, ok := err.(exporter.ProcessErrors)
+	if !ok || len(processErrors) != 1 || processErrors[0].Index != 1 {
+		t.Fatalf("got %v, expected the error of the second entry", err)
+	}
+	if !logger.contains("panic while processing entry") || !logger.contains("goroutine") {
+		t.Errorf("the panic and its stack trace are not logged: %q", logger.msgs)
+	}
+	assertLines(t, lines(w.Points()),
+		"cpu,trace=x a=1 1000000000",
+		"cpu,trace=z a=3 1000000000",
+	)
+}
+
+func TestOnError(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number?", "b": "number?"},
+	}
+	data := []string{`{"a": 1}`, `{`, `{"a": "x", "b": 3}`, `{"a": 4}`}
+	for _, onError := range []string{"", "skip"} {
+		t.Run(onError, func(t *testing.T) {
+			config.OnError = onError
+			w, err := processData(t, newExporter(t), config, data...)
+			// the entry with an invalid value is written partially.
+			processErrors, ok := err.(exporter.ProcessErrors)
+			if !ok || len(processErrors) != 1 || processErrors[0].Index != 1 {
+				t.Fatalf("got %v, expected the error of the entry that could not be unmarshaled", err)
+			}
+			assertLines(t, lines(w.Points()), "cpu a=1 1000000000", "cpu b=3 1000000000", "cpu a=4 1000000000")
+		})
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		config.OnError = "fail"
+		e := newExporter(t)
+		w, err := processData(t, e, config, data...)
+		processError, ok := err.(exporter.ProcessError)
+		if !ok || processError.Index != 1 || !errors.Is(err, exporter.ErrUnmarshal) {
+			t.Fatalf("got %v, expected the error of the first invalid entry", err)
+		}
+		if len(w.Points()) != 0 {
+			t.Errorf("got points %q, expected none", lines(w.Points()))
+		}
+		// the entries following the first invalid entry are not
+		// processed.
+		if stats := e.Stats()["cpu"]; stats.UnmarshalErrors != 1 || stats.InvalidValues != 0 {
+			t.Errorf("got stats %+v", stats)
+		}
+	})
+}
+
+func TestOptionalFields(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "cpu",
+		Fields: map[string]string{
+			"a": "number",
+			"b": "number?",
+		},
+	}
+	logger := &logRecorder{}
+	e := &exporter.Exporter{Logger: logger}
+	w, err := processData(t, e, config, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "cpu a=1 1000000000")
+	if logger.contains("entry key not found") {
+		t.Errorf("missing optional key logged: %q", logger.msgs)
+	}
+
+	if _, err := processData(t, e, config, `{"b": 1}`); err != nil {
+		t.Fatal(err)
+	}
+	if entryError := logger.entryError(exporter.ErrMissingKey); entryError == nil || entryError.Key != "a" {
+		t.Errorf("got %q, expected a missing key error for the required field", logger.msgs)
+	}
+	if !logger.contains("entry key not found") {
+		t.Errorf("missing required key not logged: %q", logger.msgs)
+	}
+	if n := e.Stats()["cpu"].MissingKeys; n != 1 {
+		t.Errorf("got %d missing keys, expected 1", n)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+// parseLine parses the line protocol of a single point.
+func parseLine(t *testing.T, line string) models.Point {
+	t.Helper()
+	if strings.ContainsAny(line, "\r\n") {
+		t.Fatalf("point %q holds a line break", line)
+	}
+	points, err := models.ParsePointsString(line)
+	if err != nil {
+		t.Fatalf("invalid point %q: %v", line, err)
+	}
+	if len(points) != 1 {
+		t.Fatalf("got %d points parsing %q, expected 1", len(points), line)
+	}
+	return points[0]
+}
+
+func TestStringFieldEscaping(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "log",
+		Fields: map[string]string{"b": "string"},
+	}
+	tests := []string{
+		`a"b`,
+		`a\b`,
+		`a\"b`,
+		"a\nb",
+		`a\`,
+	}
+	for _, value := range tests {
+		t.Run(value, func(t *testing.T) {
+			entry := `{"b": ` + quote(value) + `}`
+			got, err := buildPoints(t, newExporter(t), config, entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d points %q, expected 1", len(got), got)
+			}
+			// string fields may hold line breaks, which are quoted.
+			points, err := models.ParsePointsString(got[0])
+			if err != nil {
+				t.Fatalf("invalid point %q: %v", got[0], err)
+			}
+			if len(points) != 1 {
+				t.Fatalf("got %d points parsing %q, expected 1", len(points), got[0])
+			}
+			fields, err := points[0].Fields()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fields["b"] != value {
+				t.Errorf("got %q, expected %q", fields["b"], value)
+			}
+		})
+	}
+}
+
+func TestTagValueEscaping(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "log",
+		Fields:    map[string]string{"a": "number"},
+		TagFields: []string{"host"},
+	}
+	tests := map[string]string{
+		`a"b`:      `a"b`,
+		`a\b`:      `a\b`,
+		"a\nb":     "a b",
+		"a\r\nb":   "a b",
+		"a, b=c d": "a, b=c d",
+	}
+	for value, expected := range tests {
+		t.Run(value, func(t *testing.T) {
+			entry := `{"a": 1, "host": ` + quote(value) + `}`
+			got, err := buildPoints(t, newExporter(t), config, entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d points %q, expected 1", len(got), got)
+			}
+			point := parseLine(t, got[0])
+			if tag := point.Tags().GetString("host"); tag != expected {
+				t.Errorf("got tag %q, expected %q", tag, expected)
+			}
+		})
+	}
+}
+
+func TestFieldKeyLineBreaks(t *testing.T) {
+	tests := []struct {
+		about  string
+		config exporter.TopicConfig
+		entry  string
+	}{{
+		about: "top-k labels",
+		config: exporter.TopicConfig{
+			Topic:  "k",
+			Fields: map[string]string{"k": "top-k"},
+		},
+		entry: `{"k": {"a\nb": 1}}`,
+	}, {
+		about: "top-k item labels",
+		config: exporter.TopicConfig{
+			Topic:  "k",
+			Fields: map[string]string{"k": "top-k"},
+		},
+		entry: `{"k": [{"name": "a\r\nb", "count": 1}]}`,
+	}, {
+		about: "flattened keys",
+		config: exporter.TopicConfig{
+			Topic:   "k",
+			Flatten: true,
+		},
+		entry: `{"a\nb": {"c\rd": 1}}`,
+	}, {
+		about: "histogram keys",
+		config: exporter.TopicConfig{
+			Topic:  "k",
+			Fields: map[string]string{"h": "hist"},
+		},
+		entry: `{"h": {"1\n": 1}}`,
+	}, {
+		about: "histogram array boundaries",
+		config: exporter.TopicConfig{
+			Topic:       "k",
+			Fields:      map[string]string{"h": "hist"},
+			BucketArray: true,
+		},
+		entry: `{"h": [{"le": "1\n", "count": 1}]}`,
+	}}
+	for _, test := range tests {
+		t.Run(test.about, func(t *testing.T) {
+			got, err := buildPoints(t, newExporter(t), test.config, test.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d points %q, expected 1", len(got), got)
+			}
+			parseLine(t, got[0])
+		})
+	}
+}
+
+// quote returns the JSON string holding the value.
+func quote(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(value) + `"`
+}
+
+func TestMeasurementEscaping(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "test topic,weird",
+		Fields:    map[string]string{"a b": "number"},
+		TagFields: []string{"host name"},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"a b": 1, "host name": "x,y=z"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, `test\ topic\,weird,host\ name=x\,y\=z a\ b=1 1000000000`)
+	point := parseLine(t, got[0])
+	if name := string(point.Name()); name != "test topic,weird" {
+		t.Errorf("got measurement %q", name)
+	}
+	if tag := point.Tags().GetString("host name"); tag != "x,y=z" {
+		t.Errorf("got tag %q", tag)
+	}
+}
+
+func TestRawField(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:    "log",
+		Fields:   map[string]string{"a": "number"},
+		RawField: "raw",
+	}
+	payload := `{"a": 1, "s": "x\"y\\z"}`
+	got, err := buildPoints(t, newExporter(t), config, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, `log a=1,raw="{\"a\": 1, \"s\": \"x\\\"y\\\\z\"}" 1000000000`)
+	fields, err := parseLine(t, got[0]).Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["raw"] != payload {
+		t.Errorf("got raw field %q, expected %q", fields["raw"], payload)
+	}
+}
@@ -1,87 +1,42 @@
-package main
+// Package exporter converts the data consumed from kafka topics into
+// influxdb points and writes them.
+package exporter
 
 import (
-	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"math"
-	"math/rand"
-	"os"
-	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	client "github.com/influxdata/influxdb1-client/v2"
-	"github.com/juju/clock"
 	"github.com/juju/errors"
-	yaml "gopkg.in/yaml.v1"
 )
 
-const maxBackoff = time.Minute * 5
+// defaultDatabase holds the name of the database the points are written
+// to, unless the topic specifies one.
+const defaultDatabase = "kpi"
 
-var (
-	kafkaBrokers = os.Getenv("KAFKA_BROKERS")
-	influxAPI    = os.Getenv("INFLUX_API")
-	configFile   = os.Getenv("CONFIG")
-)
-
-type Config struct {
-	KafkaBrokers string        `yaml:"kafka-brokers,omitempty"`
-	KafkaTLS     *tlsConfig    `yaml:"kafka-tls,omitempty"`
-	InfluxDB     string        `yaml:"influx-db,omitempty"`
-	Topics       []TopicConfig `yaml:"topics"`
-}
-
-type tlsConfig struct {
-	CACert string `yaml:"ca-cert"`
-	Cert   string `yaml:"cert"`
-	Key    string `yaml:"key"`
-}
-
-func (c *Config) kafkaBrokers() string {
-	if c.KafkaBrokers != "" {
-		return c.KafkaBrokers
-	}
-	return kafkaBrokers
-}
-
-func (c *Config) tls() (*TLSConfig, error) {
-	if c.KafkaTLS == nil {
-		return nil, nil
-	}
-	cert, err := tls.LoadX509KeyPair(c.KafkaTLS.Cert, c.KafkaTLS.Key)
-	if err != nil {
-		return nil, errors.Annotate(err, "failed to load client certificate and key")
-	}
-	caCertBytes, err := ioutil.ReadFile(c.KafkaTLS.CACert)
-	if err != nil {
-		return nil, errors.Annotate(err, "failed to read CA certificate")
-	}
-	pemData, _ := pem.Decode(caCertBytes)
-	if pemData == nil {
-		return nil, errors.New("failed to decode CA certificate")
-	}
-	caCert, err := x509.ParseCertificate(pemData.Bytes)
-	if err != nil {
-		return nil, errors.Annotate(err, "invalid CA certificate")
-	}
-	return &TLSConfig{
-		Certificate:   cert,
-		CACertificate: caCert,
-	}, nil
+// RetryConfig specifies how failed influxdb writes are retried.
+type RetryConfig struct {
+	// MaxAttempts holds the maximum number of attempts to write a
+	// batch of points. If zero, failed writes are not retried.
+	MaxAttempts int `yaml:"max-attempts,omitempty"`
+	// InitialBackoff holds the time waited before the first retry.
+	// Defaults to 100ms.
+	InitialBackoff time.Duration `yaml:"initial-backoff,omitempty"`
+	// Multiplier holds the factor by which the backoff grows after
+	// each retry. Defaults to 2.
+	Multiplier float64 `yaml:"multiplier,omitempty"`
 }
 
-func (c *Config) influxDB() (*client.HTTPConfig, error) {
-	influxDBConnectionString := influxAPI
-	if c.InfluxDB != "" {
-		influxDBConnectionString = c.InfluxDB
-	}
-
+// ParseInfluxDB returns the http config of the influxdb client connecting
+// to the influxdb specified by the connection string, in the
+// "<username>:<password>@<ip>:<port>" format, the credentials being
+// optional.
+func ParseInfluxDB(influxDBConnectionString string) (*client.HTTPConfig, error) {
 	cfg := &client.HTTPConfig{}
 	// the connection string format is:
 	// <username>:<password>@<ip>:<port>
@@ -103,196 +58,833 @@ func (c *Config) influxDB() (*client.HTTPConfig, error) {
 	return cfg, nil
 }
 
+// TopicConfig specifies how the entries consumed from a kafka topic
+// are converted into influxdb points.
 type TopicConfig struct {
-	Topic  string            `yaml:"topic"`
-	Tags   map[string]string `yaml:"tags"`
+	Topic string `yaml:"topic"`
+	// Tags holds the static tags attached to every point written
+	// for the topic, regardless of the field types.
+	Tags map[string]string `yaml:"tags"`
+	// TopicRegex, if set, holds a regular expression matching the
+	// topic name whose named groups are written as static tags, e.g.
+	// `^metrics\.region-(?P<region>[^.]+)\.host-(?P<host>.+)$`.
+	TopicRegex string `yaml:"topic-regex,omitempty"`
+	// Fields maps entry keys to their field type: "number", "float",
+	// "integer", "string", "boolean", "hist" or "top-k". Types marked
+	// with a trailing "?", e.g. "number?", declare optional fields,
+	// which are not logged when missing from an entry. Keys may list
+	// fallback keys separated by "|", e.g. "latency_ms|latencyMs", in
+	// which case the first key found in an entry is used and the field
+	// is named after the first key.
 	Fields map[string]string `yaml:"fields"`
-}
+	// ComputedFields maps the names of fields computed from the
+	// numeric values of the entries to arithmetic expressions using
+	// entry keys, numbers, the +, -, * and / operators and
+	// parentheses, e.g. "used / total".
+	ComputedFields map[string]string `yaml:"computed-fields,omitempty"`
+	// StrictFields specifies that the entry keys not declared in
+	// the config, e.g. as Fields or TagFields, are logged, to detect
+	// changes of the entry schema.
+	StrictFields bool `yaml:"strict-fields,omitempty"`
+	// RequireAllFields specifies that entries missing any of the
+	// Fields keys are dropped rather than written without the missing
+	// fields. Optional fields, fields with a default value and fields
+	// whose condition does not hold are not required, and null values
+	// are missing. Sub-measurement points missing any of their fields
+	// are dropped likewise.
+	RequireAllFields bool `yaml:"require-all-fields,omitempty"`
+	// Flatten specifies that all the values of the entries are
+	// written, including those of nested objects and arrays, in
+	// addition to the Fields. The names of nested values join their
+	// keys and indexes with the FieldSeparator, e.g. "a_b_c".
+	Flatten bool `yaml:"flatten,omitempty"`
+	// MaxDepth holds the maximum depth of the nested objects and
+	// arrays flattened into fields. Defaults to 10.
+	MaxDepth int `yaml:"max-depth,omitempty"`
+	// CoerceFloat specifies that all numeric values, including those
+	// of "integer" fields, are written as floats, so that the type of
+	// the fields never changes.
+	CoerceFloat bool `yaml:"coerce-float,omitempty"`
+	// Defaults maps Fields keys to the values written when the keys
+	// are not found in an entry or their values are null. The values
+	// are parsed according to the field type.
+	Defaults map[string]string `yaml:"defaults,omitempty"`
+	// SubMeasurements holds additional measurements written from
+	// each entry, using the tags and timestamp of the topic.
+	SubMeasurements []MeasurementConfig `yaml:"sub-measurements,omitempty"`
+	// ValueMaps maps Fields keys to the translations of their values,
+	// e.g. {"2": "degraded"}. The fields must be declared as "string"
+	// and unmapped values are written as they are.
+	ValueMaps map[string]map[string]string `yaml:"value-maps,omitempty"`
+	// Scale maps the keys of "number" and "float" fields to the
+	// factor their values are multiplied by, e.g. 1/1048576 to write
+	// bytes as megabytes. A zero scale leaves the values unchanged.
+	Scale map[string]float64 `yaml:"scale,omitempty"`
+	// Clamp maps the keys of "number" and "float" fields to the range
+	// their values are clamped to, after scaling, e.g. to write
+	// negative values of counters as zero.
+	Clamp map[string]ClampConfig `yaml:"clamp,omitempty"`
+	// Transforms maps the keys of "string" fields and tag fields to
+	// the transforms applied to their values, in order: "trim",
+	// "lower" or "upper".
+	Transforms map[string][]string `yaml:"transforms,omitempty"`
+	// FieldPrefix holds the prefix prepended to the names of all
+	// written fields. Tags and measurement names are not prefixed.
+	FieldPrefix string `yaml:"field-prefix,omitempty"`
+	// FieldSeparator holds the separator used to join the parts of
+	// dotted Fields keys, which refer to values of nested objects,
+	// and the indexes of array elements, e.g. "values[1]", into field
+	// names. Defaults to "_".
+	FieldSeparator string `yaml:"field-separator,omitempty"`
+	// RawField, if set, holds the name of the string field the raw,
+	// decompressed entry payload is written to. The name is not
+	// prefixed and set topics do not write the field.
+	RawField string `yaml:"raw-field,omitempty"`
+	// FieldNames maps Fields keys to the names of the fields their
+	// values are written to. Unmapped keys keep their own name.
+	FieldNames map[string]string `yaml:"field-names,omitempty"`
+	// KeyFormat holds the printf format used to format the bucket
+	// boundaries of "hist" fields into field names, e.g. "%04d".
+	// Only the boundaries are formatted, never the bucket counts.
+	// Integer verbs format fractional boundaries as %v, e.g. "0.5".
+	KeyFormat string `yaml:"key-format,omitempty"`
+	// KeyTransform holds the transform applied to the bucket boundaries
+	// of "hist" fields before KeyFormat: "printf" formats the boundary
+	// itself, "le" writes e.g. "le=0.5" and "le=+Inf", and "log2bucket"
+	// writes the base 2 logarithm of the boundary rounded up, e.g.
+	// "2^10" for 1000, so that "sum" collisions relabel buckets
+	// exponentially. KeyFormat then formats the transformed key as a
+	// string, e.g. "bucket_%s". Defaults to "printf".
+	KeyTransform string `yaml:"key-transform,omitempty"`
+	// CollisionMode specifies how "hist" buckets whose boundaries
+	// are formatted to the same field name are handled: "last" keeps
+	// one of the values, "sum" writes the sum of the values and
+	// "error" drops the entry. Defaults to "last".
+	CollisionMode string `yaml:"collision-mode,omitempty"`
+	// BucketMin, BucketMax and BucketStep, if BucketStep is set,
+	// specify the integer bucket boundaries of "hist" fields, from
+	// BucketMin to BucketMax every BucketStep, whose buckets are
+	// written with a zero count when missing from an entry.
+	BucketMin  int `yaml:"bucket-min,omitempty"`
+	BucketMax  int `yaml:"bucket-max,omitempty"`
+	BucketStep int `yaml:"bucket-step,omitempty"`
+	// BucketArray specifies that "hist" fields hold an array of
+	// bucket objects rather than an object keyed by bucket boundary.
+	BucketArray bool `yaml:"bucket-array,omitempty"`
+	// BucketKey holds the bucket object key containing the bucket
+	// boundary. Defaults to "le".
+	BucketKey string `yaml:"bucket-key,omitempty"`
+	// CountKey holds the key of the bucket objects of "hist" fields
+	// and of the item objects of "top-k" fields containing the count.
+	// Defaults to "count".
+	CountKey string `yaml:"count-key,omitempty"`
+	// LabelKey holds the key of the item objects of "top-k" fields
+	// containing the label used as field name, when the fields hold
+	// an array of items rather than an object keyed by label.
+	// Defaults to "name".
+	LabelKey string `yaml:"label-key,omitempty"`
+	// K holds the number of highest values of "top-k" fields that
+	// are written. If zero, all values are written.
+	K int `yaml:"k,omitempty"`
+	// OtherField, if set, holds the name of the field containing the
+	// sum of the "top-k" values that are not written.
+	OtherField string `yaml:"other-field,omitempty"`
+	// MinValue, if set, holds the minimum "hist" bucket count and
+	// "top-k" value written. Lower values are omitted and are not
+	// included in the OtherField sum.
+	MinValue float64 `yaml:"min-value,omitempty"`
+	// Format holds the format of the entries: "json" or "csv".
+	// Defaults to "json".
+	Format string `yaml:"format,omitempty"`
+	// Columns holds the names of the columns of CSV entries, which
+	// are used as entry keys.
+	Columns []string `yaml:"columns,omitempty"`
+	// Root, if set, holds the dotted key of the object of the JSON
+	// entries the points are created from, e.g. "payload" for entries
+	// wrapped in an envelope such as {"meta": {...}, "payload": {...}}.
+	// All the other entry keys of the config are relative to the root
+	// object. Entries without the root object are logged and skipped.
+	Root string `yaml:"root,omitempty"`
+	// ArrayPayload specifies that each kafka message holds a JSON
+	// array of entries, all sharing the time of the message.
+	ArrayPayload bool `yaml:"array-payload,omitempty"`
+	// Compression holds the compression of the entries: "none" or
+	// "gzip". Defaults to "none".
+	Compression string `yaml:"compression,omitempty"`
+	// Filter, if set, restricts the exported entries to those
+	// matching the filter.
+	Filter *FilterConfig `yaml:"filter,omitempty"`
+	// Conditions maps Fields keys to the conditions that must hold
+	// for their values to be written. Entries not satisfying the
+	// condition of a field are written without the field.
+	Conditions map[string]ConditionConfig `yaml:"conditions,omitempty"`
+	// OnError holds the policy applied to entries that cannot be
+	// processed: "skip" writes the points of the other entries, "fail"
+	// stops processing the entries and writes no points. Defaults to
+	// "skip".
+	OnError string `yaml:"on-error,omitempty"`
+	// SampleRate, if set, holds the fraction of the entries that are
+	// written, within (0, 1]. Entries are sampled randomly.
+	SampleRate float64 `yaml:"sample-rate,omitempty"`
+	// DedupKey, if set, holds the entry key whose value identifies
+	// an entry. Entries whose identifier was already seen in the
+	// same ProcessData call are dropped.
+	DedupKey string `yaml:"dedup-key,omitempty"`
+	// SortByTime specifies that the points are written in ascending
+	// order of their timestamps. Points with the same timestamp are
+	// written in the order of their entries.
+	SortByTime bool `yaml:"sort-by-time,omitempty"`
+	// MaxPointsPerCall, if set, holds the maximum number of points
+	// held in memory by a ProcessData call: once that many points are
+	// created they are written before processing the remaining
+	// entries. The limit is checked after each entry, so a written
+	// group holds more points when the last entry creates several of
+	// them, and the last group of a set topic also holds its
+	// distinct counts. Points are then merged, deduplicated and
+	// sorted only within each written group. BuildPoints and topics
+	// whose OnError is "fail" ignore the limit, so that such topics
+	// write no points when an entry cannot be processed.
+	MaxPointsPerCall int `yaml:"max-points-per-call,omitempty"`
+	// DedupPoints specifies that identical points, with the same
+	// measurement, tags, fields and time, are written only once per
+	// ProcessData call.
+	DedupPoints bool `yaml:"dedup-points,omitempty"`
+	// Heartbeat, if set, holds the name of the measurement a point is
+	// written to on each ProcessData call, even when no entry produced
+	// points, for monitoring the liveness of the exporter. The point is
+	// tagged with the topic and has the "entries", "points" and
+	// "errors" fields, holding the number of processed entries, of
+	// points written by the call and of entries that could not be
+	// processed, as returned by the call in ProcessErrors. A call
+	// failing with any other error, e.g. a failed write, still writes
+	// the point, counting that error.
+	Heartbeat string `yaml:"heartbeat,omitempty"`
+	// Type holds the type of the topic entries. If empty, the
+	// points are created from the entry keys listed in Fields. If
+	// "gauge", each entry holds a single numeric value. If "counter",
+	// each entry holds the value of a monotonically increasing
+	// counter and the difference from the previous value is written.
+	// If "set", the number of distinct values of the value key seen
+	// in the processed entries is written. If "summary", the value
+	// key holds an array of numeric samples whose min, max, mean and
+	// count are written.
+	Type string `yaml:"type,omitempty"`
+	// Endpoint holds the connection string of the influxdb the
+	// points are written to, in the same format as the influx-db
+	// config. Defaults to the exporter's influxdb.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Database holds the name of the influxdb database the points
+	// are written to. Defaults to "kpi".
+	Database string `yaml:"database,omitempty"`
+	// RetentionPolicy holds the retention policy of the written
+	// points. Defaults to the database's default retention policy.
+	RetentionPolicy string `yaml:"retention-policy,omitempty"`
+	// WriteConsistency holds the write consistency of the points
+	// written to an influxdb cluster: "any", "one", "quorum" or
+	// "all". Defaults to the server's default.
+	WriteConsistency string `yaml:"write-consistency,omitempty"`
+	// WriteTimeout, if set, holds the maximum duration of a single
+	// write of the topic's points. Timed out writes are retried as
+	// specified by the exporter's retry config.
+	WriteTimeout time.Duration `yaml:"write-timeout,omitempty"`
+	// MaxAge, if set, holds the maximum age of the written points.
+	// Entries whose timestamp is older are dropped.
+	MaxAge time.Duration `yaml:"max-age,omitempty"`
+	// TimeBucket, if set, holds the interval the point timestamps
+	// are truncated to.
+	TimeBucket time.Duration `yaml:"time-bucket,omitempty"`
+	// MergeBuckets specifies that points of the same series whose
+	// timestamps are truncated to the same time are merged into a
+	// single point.
+	MergeBuckets bool `yaml:"merge-buckets,omitempty"`
+	// Precision holds the precision of the point timestamps written
+	// to influxdb: "ns", "us", "ms" or "s". Defaults to "ms", the
+	// precision the exporter always wrote points with, rather than
+	// "ns", which would change the timestamps of existing topics.
+	Precision string `yaml:"precision,omitempty"`
+	// ValueKey holds the entry key containing the value of a gauge,
+	// counter or set, or the samples of a summary. Defaults to
+	// "value".
+	ValueKey string `yaml:"value-key,omitempty"`
+	// FieldName holds the name of the field the value of a gauge,
+	// counter or set is written to. Defaults to the value key.
+	FieldName string `yaml:"field-name,omitempty"`
+	// Percentiles holds the percentiles of the samples of a summary
+	// written in addition to the min, max, mean and count, e.g. 95
+	// is written as the "p95" field. Percentiles are computed by
+	// linear interpolation between the closest samples.
+	Percentiles []float64 `yaml:"percentiles,omitempty"`
+	// TagFields holds the entry keys whose values are written as
+	// point tags. Keys listed both here and in Fields are only
+	// written as tags. Entries missing a key are logged and written
+	// without the tag.
+	TagFields []string `yaml:"tag-fields,omitempty"`
+	// KeyTag, if set, holds the name of the tag the kafka message
+	// key is written to, when the keys are passed to
+	// ProcessDataWithKeys.
+	KeyTag string `yaml:"key-tag,omitempty"`
+	// HeaderTags holds the names of the kafka message headers written
+	// as tags of the same name, when the headers are passed to
+	// ProcessDataWithHeaders. Missing and empty headers are skipped.
+	HeaderTags []string `yaml:"header-tags,omitempty"`
+	// TraceTagField, if set, holds the entry key containing a trace
+	// identifier written as a tag of the sampled points, for
+	// correlation with traces.
+	TraceTagField string `yaml:"trace-tag-field,omitempty"`
+	// TraceSampleRate holds the fraction of the points written with
+	// the trace tag, within [0, 1]. Points are sampled randomly, all
+	// points are written, and only the sampled ones with the tag, to
+	// limit the cardinality of the tag. If zero, the points of the
+	// entries selected by SampleRate are written with the tag, and
+	// no points are if SampleRate is not set either. The tag does not
+	// identify the series of counters, sets and merged buckets, and
+	// set points are written without it.
+	TraceSampleRate float64 `yaml:"trace-sample-rate,omitempty"`
+	// EmptyTagMode specifies how TagFields values that are empty
+	// strings or null are handled: "drop" writes the point without the tag,
+	// "placeholder" writes the EmptyTagValue instead and "skip" drops
+	// the entry. Defaults to "drop".
+	EmptyTagMode string `yaml:"empty-tag-mode,omitempty"`
+	// EmptyTagValue holds the tag value written for empty TagFields
+	// values in the "placeholder" mode. Defaults to "unknown".
+	EmptyTagValue string `yaml:"empty-tag-value,omitempty"`
 
-func main() {
-	log.Println("starting exporter")
+	// Measurement holds the name of the influxdb measurement the
+	// points are written to. Defaults to the topic name.
+	Measurement string `yaml:"measurement,omitempty"`
+	// TimestampField holds the name of the entry key containing the
+	// time of the point. If not set the kafka message time is used.
+	TimestampField string `yaml:"timestamp-field,omitempty"`
+	// TimestampFormat holds the layout used to parse the timestamp
+	// field, or one of "unix" and "unixms". Defaults to RFC3339.
+	TimestampFormat string `yaml:"timestamp-format,omitempty"`
+}
 
-	data, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		log.Fatalf("failed to read the config file: %v", err)
+// Validate checks the topic config. The rules are:
+//   - the topic must be specified,
+//   - the type must be empty, "gauge", "counter", "set" or "summary",
+//   - gauge, counter, set and summary topics must not specify Fields
+//     or Flatten,
+//   - the Fields types must be known,
+//   - KeyFormat, if set, must be a format string with a single verb,
+//     which formats a string with the "le" and "log2bucket" key
+//     transforms,
+//   - BucketStep must not be negative and, if set, BucketMax must not
+//     be lower than BucketMin and the range must hold at most 1000
+//     buckets,
+//   - Format, Precision, Compression, CollisionMode, KeyTransform,
+//     EmptyTagMode, WriteConsistency and OnError, if set, must be one
+//     of their documented values,
+//   - csv topics must specify Columns and must not specify
+//     ArrayPayload or Root,
+//   - Defaults must be valid values of declared "number", "float",
+//     "integer", "string" or "boolean" fields,
+//   - TopicRegex, if set, must be a valid regular expression,
+//   - ComputedFields must be valid expressions,
+//   - SampleRate and TraceSampleRate must be within [0, 1],
+//   - Percentiles must be within (0, 100],
+//   - Filter, if set, must specify a key,
+//   - Conditions must specify a key and the "==" or "!=" operator,
+//   - Clamp ranges must not have a minimum above their maximum.
+func (c *TopicConfig) Validate() error {
+	if c.Topic == "" {
+		return errors.New("topic not specified")
 	}
-	var config Config
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		log.Fatalf("failed to unmarshal the config file: %v", err)
+	switch c.Type {
+	case "":
+	case "gauge", "counter", "set", "summary":
+		if len(c.Fields) > 0 {
+			return errors.Errorf("fields specified for %s topic %q", c.Type, c.Topic)
+		}
+		if c.Flatten {
+			return errors.Errorf("flatten specified for %s topic %q", c.Type, c.Topic)
+		}
+	default:
+		return errors.Errorf("unknown topic type %q", c.Type)
 	}
-	tlsConfig, err := config.tls()
-	if err != nil {
-		log.Fatalf("invalid TLS configuration: %v", err)
+	if err := validateFields(c.Fields); err != nil {
+		return errors.Trace(err)
+	}
+	for key, defaultValue := range c.Defaults {
+		entryType, _ := parseFieldType(c.Fields[key])
+		if err := validateDefault(entryType, defaultValue); err != nil {
+			return errors.Annotatef(err, "invalid default of field %q", key)
+		}
+	}
+	for _, sub := range c.SubMeasurements {
+		if sub.Measurement == "" {
+			return errors.New("sub-measurement name not specified")
+		}
+		if err := validateFields(sub.Fields); err != nil {
+			return errors.Annotatef(err, "invalid sub-measurement %q", sub.Measurement)
+		}
+	}
+	for key := range c.ValueMaps {
+		// translated values are written as strings, so they would
+		// conflict with the values of fields of any other type.
+		fieldTypes := []string{c.Fields[key]}
+		for _, sub := range c.SubMeasurements {
+			if entryType, ok := sub.Fields[key]; ok {
+				fieldTypes = append(fieldTypes, entryType)
+			}
+		}
+		for _, entryType := range fieldTypes {
+			if entryType, _ := parseFieldType(entryType); entryType != "string" {
+				return errors.Errorf("value map of field %q not declared as string", key)
+			}
+		}
+	}
+	if c.KeyFormat != "" {
+		verbs, ok := formatVerbs(c.KeyFormat)
+		if !ok || len(verbs) != 1 {
+			return errors.Errorf("invalid key format %q", c.KeyFormat)
+		}
+		switch c.KeyTransform {
+		case "le", "log2bucket":
+			if strings.IndexByte("sqv", verbs[0]) < 0 {
+				return errors.Errorf("key format %q does not format the string keys of key transform %q", c.KeyFormat, c.KeyTransform)
+			}
+		}
 	}
+	switch c.Precision {
+	case "", "ns", "us", "ms", "s":
+	default:
+		return errors.Errorf("invalid precision %q", c.Precision)
+	}
+	switch c.Format {
+	case "", "json":
+	case "csv":
+		if len(c.Columns) == 0 {
+			return errors.New("columns not specified for csv topic")
+		}
+		if c.ArrayPayload {
+			return errors.New("array payload specified for csv topic")
+		}
+		if c.Root != "" {
+			return errors.New("root specified for csv topic")
+		}
+	default:
+		return errors.Errorf("invalid format %q", c.Format)
+	}
+	switch c.Compression {
+	case "", "none", "gzip":
+	default:
+		return errors.Errorf("invalid compression %q", c.Compression)
+	}
+	switch c.CollisionMode {
+	case "", "last", "sum", "error":
+	default:
+		return errors.Errorf("invalid collision mode %q", c.CollisionMode)
+	}
+	if c.BucketStep < 0 {
+		return errors.Errorf("invalid bucket step %d", c.BucketStep)
+	}
+	if c.BucketStep > 0 {
+		if c.BucketMax < c.BucketMin {
+			return errors.Errorf("bucket max %d lower than bucket min %d", c.BucketMax, c.BucketMin)
+		}
+		if c.filledBuckets() > maxFilledBuckets {
+			return errors.Errorf("too many buckets from %d to %d every %d", c.BucketMin, c.BucketMax, c.BucketStep)
+		}
+	}
+	switch c.KeyTransform {
+	case "", "printf", "le", "log2bucket":
+	default:
+		return errors.Errorf("invalid key transform %q", c.KeyTransform)
+	}
+	switch c.WriteConsistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		return errors.Errorf("invalid write consistency %q", c.WriteConsistency)
+	}
+	switch c.OnError {
+	case "", "skip", "fail":
+	default:
+		return errors.Errorf("invalid error policy %q", c.OnError)
+	}
+	switch c.EmptyTagMode {
+	case "", "drop", "placeholder", "skip":
+	default:
+		return errors.Errorf("invalid empty tag mode %q", c.EmptyTagMode)
+	}
+	if c.TopicRegex != "" {
+		if _, err := regexp.Compile(c.TopicRegex); err != nil {
+			return errors.Annotate(err, "invalid topic regex")
+		}
+	}
+	for name, s := range c.ComputedFields {
+		if _, err := parseExpression(s); err != nil {
+			return errors.Annotatef(err, "invalid computed field %q", name)
+		}
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return errors.Errorf("invalid sample rate %v", c.SampleRate)
+	}
+	if c.TraceSampleRate < 0 || c.TraceSampleRate > 1 {
+		return errors.Errorf("invalid trace sample rate %v", c.TraceSampleRate)
+	}
+	for _, percentile := range c.Percentiles {
+		if percentile <= 0 || percentile > 100 {
+			return errors.Errorf("invalid percentile %v", percentile)
+		}
+	}
+	if c.Filter != nil && c.Filter.Key == "" {
+		return errors.New("filter key not specified")
+	}
+	for key, condition := range c.Conditions {
+		if condition.Key == "" {
+			return errors.Errorf("condition key not specified for field %q", key)
+		}
+		switch condition.Operator {
+		case "==", "!=":
+		default:
+			return errors.Errorf("invalid condition operator %q for field %q", condition.Operator, key)
+		}
+	}
+	for key, clamp := range c.Clamp {
+		if clamp.Min != nil && clamp.Max != nil && *clamp.Min > *clamp.Max {
+			return errors.Errorf("invalid clamp range [%v, %v] of field %q", *clamp.Min, *clamp.Max, key)
+		}
+	}
+	return nil
+}
 
-	ctx, cancelFn := context.WithCancel(context.Background())
-	defer cancelFn()
+// maxFilledBuckets holds the maximum number of histogram buckets in the
+// range specified by BucketMin, BucketMax and BucketStep.
+const maxFilledBuckets = 1000
 
-	clientCfg, err := config.influxDB()
-	if err != nil {
-		log.Fatalf("invalid influxdb connection string: %v", err)
+// filledBuckets returns the number of histogram buckets in the range
+// specified by BucketMin, BucketMax and BucketStep, or 0 if the range is
+// empty. The count does not overflow for any range.
+func (c *TopicConfig) filledBuckets() uint64 {
+	if c.BucketStep <= 0 || c.BucketMax < c.BucketMin {
+		return 0
 	}
-	httpClient, err := client.NewHTTPClient(*clientCfg)
-	if err != nil {
-		log.Fatalf("failed to create http client: %v", err)
-	}
-	defer httpClient.Close()
-	if _, err := httpClient.Query(client.Query{Command: "CREATE DATABASE kpi"}); err != nil {
-		log.Fatalf("failed to create database: %v", err)
-	}
-
-	consumers := make([]*Consumer, 0)
-	go func() {
-		tries := 0
-		nextTime := (time.Duration(math.Exp2(float64(tries))) * time.Millisecond) + time.Duration(rand.Intn(100))
-		timer := time.NewTimer(nextTime)
-		topics := config.Topics
-
-		for len(topics) > 0 {
-			var tmpTopics []TopicConfig
-
-			for _, topicConfig := range topics {
-				consumer, err := startConsumer(ctx, config.kafkaBrokers(), tlsConfig, httpClient, topicConfig)
-				if err != nil {
-					log.Printf("failed to start consumer with topic: %s: %v", topicConfig.Topic, err)
-					tmpTopics = append(tmpTopics, topicConfig)
-				} else {
-					consumers = append(consumers, consumer)
-				}
-			}
-			topics = tmpTopics
+	// the difference may overflow an int, but not an uint64.
+	steps := uint64(c.BucketMax-c.BucketMin) / uint64(c.BucketStep)
+	if steps == math.MaxUint64 {
+		return steps
+	}
+	return steps + 1
+}
 
-			tries++
-			nextTime = (time.Duration(math.Exp2(float64(tries))) * time.Millisecond) + time.Duration(rand.Intn(100))
-			if nextTime > maxBackoff {
-				log.Printf("next timer %+v surpasses the max backoff time of %+v, setting to max backoff time\n", nextTime.String(), maxBackoff.String())
-				nextTime = maxBackoff
-			}
+// validateFields checks that the types of the fields are known.
+func validateFields(fields map[string]string) error {
+	for key, entryType := range fields {
+		entryType, _ := parseFieldType(entryType)
+		switch entryType {
+		case "number", "float", "integer", "string", "boolean", "hist", "top-k":
+		default:
+			return errors.Errorf("unknown type %q of field %q", entryType, key)
+		}
+	}
+	return nil
+}
 
-			timer = time.NewTimer(nextTime)
-			var failingTopics []string
-			for _, topic := range topics {
-				failingTopics = append(failingTopics, topic.Topic)
-			}
-			log.Printf("scheduling next retry: %+v, tries: %d, topics failing: %+v\n", nextTime.String(), tries+1, failingTopics)
+// parseFieldType returns the field type and whether the field is
+// optional, i.e. marked with a trailing "?", e.g. "number?".
+func parseFieldType(entryType string) (string, bool) {
+	if strings.HasSuffix(entryType, "?") {
+		return strings.TrimSuffix(entryType, "?"), true
+	}
+	return entryType, false
+}
 
-			select {
-			case <-ctx.Done():
-				log.Println("context canceled, exiting backoff")
-				return
-			case <-timer.C:
-			}
+// validateDefault checks that the default value is valid for a field of
+// the given type.
+func validateDefault(entryType, defaultValue string) error {
+	var err error
+	switch entryType {
+	case "number", "float":
+		_, err = strconv.ParseFloat(defaultValue, 64)
+	case "integer":
+		_, err = strconv.ParseInt(defaultValue, 10, 64)
+	case "boolean":
+		if _, ok := booleanValue(defaultValue); !ok {
+			err = errors.Errorf("invalid boolean value %q", defaultValue)
 		}
-	}()
+	case "string":
+	case "":
+		err = errors.New("field not specified")
+	default:
+		err = errors.Errorf("defaults not supported for %s fields", entryType)
+	}
+	return errors.Trace(err)
+}
 
-	defer func() {
-		for _, consumer := range consumers {
-			err := consumer.Close()
-			if err != nil {
-				log.Printf("failed to stop consumer for topic %q: %v", consumer.Topic, err)
-				continue
-			}
+// formatVerbs returns the verbs of the printf format string, or false if
+// the format string is malformed.
+func formatVerbs(format string) (string, bool) {
+	var verbs []byte
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+		// skip flags, width and precision
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i == len(format) {
+			return "", false
 		}
-	}()
+		verbs = append(verbs, format[i])
+	}
+	return string(verbs), true
+}
+
+// MeasurementConfig specifies an additional measurement written from the
+// entries of a topic.
+type MeasurementConfig struct {
+	// Measurement holds the name of the measurement.
+	Measurement string `yaml:"measurement"`
+	// Fields maps entry keys to their field type, as the Fields of
+	// the topic config.
+	Fields map[string]string `yaml:"fields"`
+}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+// ClampConfig specifies the range of the values of a field. Values below
+// the minimum or above the maximum are replaced with the bound.
+type ClampConfig struct {
+	// Min, if set, holds the minimum value.
+	Min *float64 `yaml:"min,omitempty"`
+	// Max, if set, holds the maximum value.
+	Max *float64 `yaml:"max,omitempty"`
+	// Log specifies that clamped values are logged.
+	Log bool `yaml:"log,omitempty"`
+}
 
-	select {
-	case <-c:
-		log.Println("got interrupt")
-		return
+// clamp returns the value clamped to the range, and whether the value
+// was outside the range.
+func (c ClampConfig) clamp(value float64) (float64, bool) {
+	if c.Min != nil && value < *c.Min {
+		return *c.Min, true
+	}
+	if c.Max != nil && value > *c.Max {
+		return *c.Max, true
 	}
+	return value, false
 }
 
-func startConsumer(ctx context.Context, kafkaBrokers string, tlsConfig *TLSConfig, influxClient client.Client, config TopicConfig) (*Consumer, error) {
-	consumerConfig := ConsumerConfig{
-		Context:          ctx,
-		Brokers:          strings.Split(kafkaBrokers, ","),
-		TLSConfig:        tlsConfig,
-		Topic:            config.Topic,
-		GroupName:        "influx-consumer",
-		Clock:            clock.WallClock,
-		ConsumePeriod:    time.Minute,
-		StartWaitTime:    30 * time.Second,
-		MaximumCacheSize: 10000,
-		Consume: func(ctx context.Context, data [][]byte, timestamps []time.Time) error {
-			points := make([]*client.Point, len(data))
-			for i, datum := range data {
-				var entry map[string]interface{}
-				err := json.Unmarshal(datum, &entry)
-				if err != nil {
-					log.Printf("failed to unmarshal a data point: %v", err)
-					continue
-				}
-				log.Printf("looking for fields: %v", config.Fields)
-				entryC := make(map[string]interface{})
-				for key, entryType := range config.Fields {
-					entryValue, ok := entry[key]
-					if !ok {
-						log.Printf("entry key not found: %v", key)
-						continue
-					}
-					switch entryType {
-					case "number":
-						entryC[key] = entryValue.(float64)
-					case "string":
-						entryC[key] = entryValue.(string)
-					case "hist":
-						vals := entryValue.(map[string]interface{})
-						for k, v := range vals {
-							entryC[k] = v.(float64)
-						}
-					default:
-						log.Printf("unknown entry type %v", entryType)
-					}
-				}
-				log.Printf("sending %v", entryC)
-				p, err := client.NewPoint(
-					config.Topic,
-					config.Tags,
-					entryC,
-					timestamps[i],
-				)
-				if err != nil {
-					log.Printf("failed to create a new data point")
-					continue
-				}
-				points[i] = p
-			}
-			for len(points) > 0 {
-				bp, err := client.NewBatchPoints(
-					client.BatchPointsConfig{
-						Database:  "kpi",
-						Precision: "ms",
-					},
-				)
-				if err != nil {
-					log.Printf("failed to create a batch of points: %v", err)
-					continue
-				}
-
-				max := 5000
-				if len(points) < max {
-					max = len(points)
-				}
-				bp.AddPoints(points[:max-1])
-				points = points[max:]
-
-				if err = influxClient.Write(bp); err != nil {
-					log.Printf("failed to send a batch of points: %v", err)
-					continue
-				}
-			}
+// FilterConfig specifies which entries of a topic are exported: only
+// entries whose value of the filter key is one of the filter values.
+type FilterConfig struct {
+	Key    string   `yaml:"key"`
+	Values []string `yaml:"values"`
+}
 
-			return nil
-		},
+// matches returns true if the entry passes the filter.
+func (f *FilterConfig) matches(entry map[string]interface{}) bool {
+	if f == nil {
+		return true
 	}
+	value, ok := lookup(entry, f.Key)
+	if !ok {
+		return false
+	}
+	s := fmt.Sprint(value)
+	for _, v := range f.Values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ConditionConfig specifies when a field is written: only when the value
+// of the condition key is equal ("==") or not equal ("!=") to the
+// condition value.
+type ConditionConfig struct {
+	Key      string `yaml:"key"`
+	Operator string `yaml:"operator"`
+	Value    string `yaml:"value"`
+}
+
+// holds returns true if the entry satisfies the condition. A condition
+// never holds for entries without the condition key.
+func (c ConditionConfig) holds(entry map[string]interface{}) bool {
+	value, ok := lookup(entry, c.Key)
+	if !ok {
+		return false
+	}
+	equal := fmt.Sprint(value) == c.Value
+	if c.Operator == "!=" {
+		return !equal
+	}
+	return equal
+}
 
-	consumer, err := NewConsumer(consumerConfig)
+// measurement returns the name of the influxdb measurement to which
+// the topic's points are written.
+func (c *TopicConfig) measurement() string {
+	if c.Measurement != "" {
+		return c.Measurement
+	}
+	return c.Topic
+}
+
+// isTagField returns true if the entry key is written as a tag.
+func (c *TopicConfig) isTagField(key string) bool {
+	for _, tagField := range c.TagFields {
+		if tagField == key {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldKey returns the name of the field holding the value of the
+// entry key. Dots and array indexes are replaced with the separator,
+// e.g. "cpu.values[1]" is written as "cpu_values_1". Keys listing
+// fallback keys are written as their first key, e.g. "latency_ms|latencyMs"
+// is written as "latency_ms".
+func (c *TopicConfig) fieldKey(key string) string {
+	if name, ok := c.FieldNames[key]; ok {
+		return name
+	}
+	if i := strings.IndexByte(key, '|'); i >= 0 {
+		key = key[:i]
+	}
+	separator := c.FieldSeparator
+	if separator == "" {
+		separator = "_"
+	}
+	return strings.NewReplacer(".", separator, "[", separator, "]", "").Replace(key)
+}
+
+// bucketKey returns the name of the field holding the count of the
+// histogram bucket with the given boundary.
+func (c *TopicConfig) bucketKey(boundary string) string {
+	switch c.KeyTransform {
+	case "le":
+		key := "le=" + infBoundary(boundary)
+		if c.KeyFormat == "" {
+			return key
+		}
+		return fmt.Sprintf(c.KeyFormat, key)
+	case "log2bucket":
+		key := log2Boundary(boundary)
+		if c.KeyFormat == "" {
+			return key
+		}
+		return fmt.Sprintf(c.KeyFormat, key)
+	}
+	if c.KeyFormat == "" {
+		return boundary
+	}
+	n := json.Number(boundary)
+	if i, err := n.Int64(); err == nil {
+		return fmt.Sprintf(c.KeyFormat, i)
+	}
+	f, err := n.Float64()
 	if err != nil {
-		return nil, errors.Trace(err)
+		return fmt.Sprintf(c.KeyFormat, boundary)
+	}
+	if verbs, _ := formatVerbs(c.KeyFormat); len(verbs) != 1 || strings.IndexByte("cdoOqU", verbs[0]) < 0 {
+		return fmt.Sprintf(c.KeyFormat, f)
+	}
+	// integer verbs do not format floats: integral boundaries such as
+	// "1e3" are formatted as integers, others by %v.
+	if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return fmt.Sprintf(c.KeyFormat, int64(f))
+	}
+	return fmt.Sprintf(plainVerb(c.KeyFormat), boundary)
+}
+
+// plainVerb returns the printf format string with its flags, width,
+// precision and verb replaced with %v.
+func plainVerb(format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		b.WriteByte(format[i])
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+		b.WriteByte('v')
+	}
+	return b.String()
+}
+
+// infBoundary returns the boundary with the spellings of positive
+// infinity, e.g. "inf" or "Infinity", replaced with "+Inf".
+func infBoundary(boundary string) string {
+	if f, err := strconv.ParseFloat(boundary, 64); err == nil && math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return boundary
+}
+
+// log2Boundary returns the base 2 logarithm of the positive boundary
+// rounded up, as "2^n". Other boundaries are returned unchanged, except
+// for positive infinity which is returned as "+Inf".
+func log2Boundary(boundary string) string {
+	f, err := strconv.ParseFloat(boundary, 64)
+	if err != nil || f <= 0 {
+		return boundary
+	}
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("2^%d", int(math.Ceil(math.Log2(f))))
+}
+
+// fieldName returns the name of the field holding the value of a gauge,
+// counter or set.
+func (c *TopicConfig) fieldName() string {
+	if c.FieldName != "" {
+		return c.FieldName
+	}
+	if c.ValueKey != "" {
+		return c.ValueKey
+	}
+	return "value"
+}
+
+// database returns the name of the influxdb database to which the
+// topic's points are written.
+func (c *TopicConfig) database() string {
+	if c.Database != "" {
+		return c.Database
+	}
+	return defaultDatabase
+}
+
+// precision returns the precision of the point timestamps.
+func (c *TopicConfig) precision() string {
+	if c.Precision != "" {
+		return c.Precision
+	}
+	return "ms"
+}
+
+// CreateDatabases creates the databases of the topics written to the
+// influxdb endpoint. The default database is created on the default
+// endpoint.
+func CreateDatabases(influxClient client.Client, topics []TopicConfig, endpoint string) error {
+	databases := make(map[string]bool)
+	if endpoint == "" {
+		databases[defaultDatabase] = true
+	}
+	for _, topicConfig := range topics {
+		if topicConfig.Endpoint == endpoint {
+			databases[topicConfig.database()] = true
+		}
+	}
+	for database := range databases {
+		if _, err := influxClient.Query(client.Query{Command: fmt.Sprintf("CREATE DATABASE %q", database)}); err != nil {
+			return errors.Annotatef(err, "failed to create database %v", database)
+		}
 	}
-	return consumer, nil
+	return nil
 }
@@ -0,0 +1,389 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+	"github.com/cloud-green/metamorphosis/exporter/exportertest"
+)
+
+// epoch is the time of the entries processed by the tests.
+var epoch = time.Unix(1, 0)
+
+// testLogger logs the messages of the exporter to the test log.
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(format string, args ...interface{}) {
+	l.t.Helper()
+	l.t.Logf(format, args...)
+}
+
+// logRecorder records the messages and the entry errors logged by the
+// exporter.
+type logRecorder struct {
+	mu   sync.Mutex
+	msgs []string
+	errs []*exporter.EntryError
+}
+
+func (l *logRecorder) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+	for _, arg := range args {
+		if entryError, ok := arg.(*exporter.EntryError); ok {
+			l.errs = append(l.errs, entryError)
+		}
+	}
+}
+
+// entryError returns the first logged entry error of the kind, or nil.
+func (l *logRecorder) entryError(kind error) *exporter.EntryError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entryError := range l.errs {
+		if entryError.Kind == kind {
+			return entryError
+		}
+	}
+	return nil
+}
+
+// contains returns true if a recorded message holds the string.
+func (l *logRecorder) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.msgs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// newExporter returns an exporter logging to the test log.
+func newExporter(t *testing.T) *exporter.Exporter {
+	return &exporter.Exporter{
+		Logger: testLogger{t},
+	}
+}
+
+// entries returns the data of the JSON entries.
+func entries(jsonEntries ...string) [][]byte {
+	data := make([][]byte, len(jsonEntries))
+	for i, entry := range jsonEntries {
+		data[i] = []byte(entry)
+	}
+	return data
+}
+
+// processData processes the JSON entries, all timestamped with the
+// epoch, and returns the writer that recorded the written points.
+func processData(t *testing.T, e *exporter.Exporter, config exporter.TopicConfig, jsonEntries ...string) (*exportertest.RecordingWriter, error) {
+	w := &exportertest.RecordingWriter{}
+	err := e.ProcessData(context.Background(), config, w, entries(jsonEntries...), []time.Time{epoch})
+	return w, err
+}
+
+// buildPoints returns the line protocol of the points built from the
+// JSON entries, all timestamped with the epoch.
+func buildPoints(t *testing.T, e *exporter.Exporter, config exporter.TopicConfig, jsonEntries ...string) ([]string, error) {
+	bp, err := e.BuildPoints(config, entries(jsonEntries...), []time.Time{epoch})
+	if bp == nil {
+		return nil, err
+	}
+	return lines(bp.Points()), err
+}
+
+// lines returns the line protocol of the points.
+func lines(points []*client.Point) []string {
+	result := make([]string, len(points))
+	for i, point := range points {
+		result[i] = point.String()
+	}
+	return result
+}
+
+// assertLines checks that the points are the expected lines of line
+// protocol, in order.
+func assertLines(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("got %d points %q, expected %d points %q", len(got), got, len(expected), expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("point %d is %q, expected %q", i, got[i], expected[i])
+		}
+	}
+}
+
+func TestValidateKeyFormat(t *testing.T) {
+	tests := []struct {
+		transform, format string
+		valid             bool
+	}{
+		{"", "%04d", true},
+		{"printf", "%.1f", true},
+		{"", "%d%d", false},
+		{"", "%", false},
+		{"le", "bucket_%s", true},
+		{"le", "%q", true},
+		{"le", "%04d", false},
+		{"log2bucket", "%v", true},
+		{"log2bucket", "%.2f", false},
+	}
+	for _, test := range tests {
+		config := exporter.TopicConfig{
+			Topic:        "latency",
+			Fields:       map[string]string{"h": "hist"},
+			KeyTransform: test.transform,
+			KeyFormat:    test.format,
+		}
+		err := config.Validate()
+		if test.valid && err != nil {
+			t.Errorf("key format %q of transform %q: %v", test.format, test.transform, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("key format %q of transform %q: expected an error", test.format, test.transform)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	one, zero := 1.0, 0.0
+	tests := []struct {
+		about  string
+		config func(*exporter.TopicConfig)
+		err    string
+	}{{
+		about:  "valid config",
+		config: func(c *exporter.TopicConfig) {},
+	}, {
+		about:  "no topic",
+		config: func(c *exporter.TopicConfig) { c.Topic = "" },
+		err:    "topic not specified",
+	}, {
+		about:  "unknown type",
+		config: func(c *exporter.TopicConfig) { c.Type = "histogram" },
+		err:    `unknown topic type "histogram"`,
+	}, {
+		about:  "fields of a gauge",
+		config: func(c *exporter.TopicConfig) { c.Type = "gauge" },
+		err:    `fields specified for gauge topic "cpu"`,
+	}, {
+		about: "flattened counter",
+		config: func(c *exporter.TopicConfig) {
+			c.Type = "counter"
+			c.Fields = nil
+			c.Flatten = true
+		},
+		err: `flatten specified for counter topic "cpu"`,
+	}, {
+		about:  "unknown field type",
+		config: func(c *exporter.TopicConfig) { c.Fields["b"] = "int" },
+		err:    `unknown type "int" of field "b"`,
+	}, {
+		about:  "invalid default",
+		config: func(c *exporter.TopicConfig) { c.Defaults = map[string]string{"a": "x"} },
+		err:    `invalid default of field "a"`,
+	}, {
+		about:  "default of an undeclared field",
+		config: func(c *exporter.TopicConfig) { c.Defaults = map[string]string{"b": "1"} },
+		err:    "field not specified",
+	}, {
+		about:  "value map of a number field",
+		config: func(c *exporter.TopicConfig) { c.ValueMaps = map[string]map[string]string{"a": {"1": "ok"}} },
+		err:    `value map of field "a" not declared as string`,
+	}, {
+		about: "value map of a sub-measurement number field",
+		config: func(c *exporter.TopicConfig) {
+			c.Fields["s"] = "string"
+			c.SubMeasurements = []exporter.MeasurementConfig{{Measurement: "sub", Fields: map[string]string{"s": "number"}}}
+			c.ValueMaps = map[string]map[string]string{"s": {"1": "ok"}}
+		},
+		err: `value map of field "s" not declared as string`,
+	}, {
+		about: "unnamed sub-measurement",
+		config: func(c *exporter.TopicConfig) {
+			c.SubMeasurements = []exporter.MeasurementConfig{{Fields: map[string]string{"a": "number"}}}
+		},
+		err: "sub-measurement name not specified",
+	}, {
+		about:  "invalid key format",
+		config: func(c *exporter.TopicConfig) { c.KeyFormat = "%d-%d" },
+		err:    `invalid key format "%d-%d"`,
+	}, {
+		about:  "invalid precision",
+		config: func(c *exporter.TopicConfig) { c.Precision = "m" },
+		err:    `invalid precision "m"`,
+	}, {
+		about:  "invalid format",
+		config: func(c *exporter.TopicConfig) { c.Format = "xml" },
+		err:    `invalid format "xml"`,
+	}, {
+		about:  "csv without columns",
+		config: func(c *exporter.TopicConfig) { c.Format = "csv" },
+		err:    "columns not specified for csv topic",
+	}, {
+		about: "csv array payload",
+		config: func(c *exporter.TopicConfig) {
+			c.Format = "csv"
+			c.Columns = []string{"a"}
+			c.ArrayPayload = true
+		},
+		err: "array payload specified for csv topic",
+	}, {
+		about: "csv root",
+		config: func(c *exporter.TopicConfig) {
+			c.Format = "csv"
+			c.Columns = []string{"a"}
+			c.Root = "payload"
+		},
+		err: "root specified for csv topic",
+	}, {
+		about:  "invalid compression",
+		config: func(c *exporter.TopicConfig) { c.Compression = "zstd" },
+		err:    `invalid compression "zstd"`,
+	}, {
+		about:  "invalid collision mode",
+		config: func(c *exporter.TopicConfig) { c.CollisionMode = "first" },
+		err:    `invalid collision mode "first"`,
+	}, {
+		about:  "negative bucket step",
+		config: func(c *exporter.TopicConfig) { c.BucketStep = -1 },
+		err:    "invalid bucket step -1",
+	}, {
+		about: "inverted bucket range",
+		config: func(c *exporter.TopicConfig) {
+			c.BucketMin, c.BucketMax, c.BucketStep = 10, 0, 1
+		},
+		err: "bucket max 0 lower than bucket min 10",
+	}, {
+		about: "too many buckets",
+		config: func(c *exporter.TopicConfig) {
+			c.BucketMin, c.BucketMax, c.BucketStep = 0, 1000, 1
+		},
+		err: "too many buckets from 0 to 1000 every 1",
+	}, {
+		about: "too many buckets overflowing the range",
+		config: func(c *exporter.TopicConfig) {
+			maxInt := int(^uint(0) >> 1)
+			c.BucketMin, c.BucketMax, c.BucketStep = -maxInt-1, maxInt, 1
+		},
+		err: "too many buckets from",
+	}, {
+		about:  "invalid key transform",
+		config: func(c *exporter.TopicConfig) { c.KeyTransform = "ge" },
+		err:    `invalid key transform "ge"`,
+	}, {
+		about:  "invalid write consistency",
+		config: func(c *exporter.TopicConfig) { c.WriteConsistency = "most" },
+		err:    `invalid write consistency "most"`,
+	}, {
+		about:  "invalid error policy",
+		config: func(c *exporter.TopicConfig) { c.OnError = "ignore" },
+		err:    `invalid error policy "ignore"`,
+	}, {
+		about:  "invalid empty tag mode",
+		config: func(c *exporter.TopicConfig) { c.EmptyTagMode = "keep" },
+		err:    `invalid empty tag mode "keep"`,
+	}, {
+		about:  "invalid topic regex",
+		config: func(c *exporter.TopicConfig) { c.TopicRegex = "(" },
+		err:    "invalid topic regex",
+	}, {
+		about:  "invalid computed field",
+		config: func(c *exporter.TopicConfig) { c.ComputedFields = map[string]string{"r": "a /"} },
+		err:    `invalid computed field "r"`,
+	}, {
+		about:  "invalid sample rate",
+		config: func(c *exporter.TopicConfig) { c.SampleRate = 1.5 },
+		err:    "invalid sample rate 1.5",
+	}, {
+		about:  "invalid trace sample rate",
+		config: func(c *exporter.TopicConfig) { c.TraceSampleRate = -1 },
+		err:    "invalid trace sample rate -1",
+	}, {
+		about:  "invalid percentile",
+		config: func(c *exporter.TopicConfig) { c.Percentiles = []float64{0} },
+		err:    "invalid percentile 0",
+	}, {
+		about:  "filter without key",
+		config: func(c *exporter.TopicConfig) { c.Filter = &exporter.FilterConfig{} },
+		err:    "filter key not specified",
+	}, {
+		about: "condition without key",
+		config: func(c *exporter.TopicConfig) {
+			c.Conditions = map[string]exporter.ConditionConfig{"a": {Operator: "=="}}
+		},
+		err: `condition key not specified for field "a"`,
+	}, {
+		about: "invalid condition operator",
+		config: func(c *exporter.TopicConfig) {
+			c.Conditions = map[string]exporter.ConditionConfig{"a": {Key: "b", Operator: "<"}}
+		},
+		err: `invalid condition operator "<" for field "a"`,
+	}, {
+		about: "invalid clamp range",
+		config: func(c *exporter.TopicConfig) {
+			c.Clamp = map[string]exporter.ClampConfig{"a": {Min: &one, Max: &zero}}
+		},
+		err: `invalid clamp range [1, 0] of field "a"`,
+	}}
+	for _, test := range tests {
+		t.Run(test.about, func(t *testing.T) {
+			config := exporter.TopicConfig{
+				Topic:  "cpu",
+				Fields: map[string]string{"a": "number"},
+			}
+			test.config(&config)
+			err := config.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var global bytes.Buffer
+	log.SetOutput(&global)
+	defer log.SetOutput(os.Stderr)
+
+	logger := &logRecorder{}
+	e := &exporter.Exporter{Logger: logger}
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	if _, err := e.BuildPoints(config, entries(`{"b": 1}`), []time.Time{epoch}); err == nil {
+		t.Fatal("expected a missing key error")
+	}
+	if !logger.contains("entry key not found: a") {
+		t.Errorf("the missing key was not logged: %q", logger.msgs)
+	}
+	if global.Len() > 0 {
+		t.Errorf("got messages logged with the standard logger: %q", global.String())
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+// Package exportertest provides helpers for testing the points written
+// by the exporter.
+package exportertest
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/errors"
+)
+
+// RecordingWriter is a writer recording the written batches of points.
+// It implements the Writer interface of the exporter, and is safe for
+// concurrent use.
+type RecordingWriter struct {
+	// Err, if set, is returned by Write, and the batch of points is
+	// not recorded.
+	Err error
+
+	mu      sync.Mutex
+	batches []client.BatchPoints
+}
+
+// Write records the batch of points.
+func (w *RecordingWriter) Write(bp client.BatchPoints) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.Err != nil {
+		return w.Err
+	}
+	w.batches = append(w.batches, bp)
+	return nil
+}
+
+// BatchPoints returns the recorded batches of points, in the order they
+// were written.
+func (w *RecordingWriter) BatchPoints() []client.BatchPoints {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]client.BatchPoints(nil), w.batches...)
+}
+
+// Points returns the points of all the recorded batches, in the order
+// they were written.
+func (w *RecordingWriter) Points() []*client.Point {
+	var points []*client.Point
+	for _, bp := range w.BatchPoints() {
+		points = append(points, bp.Points()...)
+	}
+	return points
+}
+
+// Find returns the recorded points matching the matcher.
+func (w *RecordingWriter) Find(m PointMatcher) []*client.Point {
+	var points []*client.Point
+	for _, point := range w.Points() {
+		if m.Match(point) == nil {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// Reset discards the recorded batches of points.
+func (w *RecordingWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = nil
+}
+
+// PointMatcher specifies the expected contents of a point. Only the
+// specified tags and fields are checked, the point may hold others.
+type PointMatcher struct {
+	// Measurement, if set, holds the name of the measurement.
+	Measurement string
+	// Tags holds the expected tag values.
+	Tags map[string]string
+	// Fields holds the expected field values, with the types written
+	// by the exporter, e.g. float64 for "number" fields and int64 for
+	// "integer" fields.
+	Fields map[string]interface{}
+}
+
+// Match returns an error describing the first difference between the
+// point and the expected contents, or nil if the point matches.
+func (m PointMatcher) Match(point *client.Point) error {
+	if point == nil {
+		return errors.New("nil point")
+	}
+	if m.Measurement != "" && point.Name() != m.Measurement {
+		return errors.Errorf("measurement %q, expected %q", point.Name(), m.Measurement)
+	}
+	tags := point.Tags()
+	for key, expected := range m.Tags {
+		value, ok := tags[key]
+		if !ok {
+			return errors.Errorf("tag %q not found", key)
+		}
+		if value != expected {
+			return errors.Errorf("tag %q is %q, expected %q", key, value, expected)
+		}
+	}
+	fields, err := point.Fields()
+	if err != nil {
+		return errors.Annotate(err, "invalid point fields")
+	}
+	for key, expected := range m.Fields {
+		value, ok := fields[key]
+		if !ok {
+			return errors.Errorf("field %q not found", key)
+		}
+		if !reflect.DeepEqual(value, expected) {
+			return errors.Errorf("field %q is %s, expected %s", key, describe(value), describe(expected))
+		}
+	}
+	return nil
+}
+
+// describe returns the value along with its type, which matters when
+// comparing field values.
+func describe(value interface{}) string {
+	return fmt.Sprintf("%v (%T)", value, value)
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exportertest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+	"github.com/cloud-green/metamorphosis/exporter/exportertest"
+)
+
+// newPoint returns a point of the cpu measurement.
+func newPoint(t *testing.T, tags map[string]string, fields map[string]interface{}) *client.Point {
+	t.Helper()
+	point, err := client.NewPoint("cpu", tags, fields, time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return point
+}
+
+// newBatch returns a batch holding the points.
+func newBatch(t *testing.T, points ...*client.Point) client.BatchPoints {
+	t.Helper()
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: "kpi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.AddPoints(points)
+	return bp
+}
+
+func TestRecordingWriter(t *testing.T) {
+	a := newPoint(t, map[string]string{"host": "a"}, map[string]interface{}{"user": 0.5})
+	b := newPoint(t, map[string]string{"host": "b"}, map[string]interface{}{"user": 1.5})
+	w := &exportertest.RecordingWriter{}
+	if err := w.Write(newBatch(t, a)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(newBatch(t, b)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.BatchPoints()); n != 2 {
+		t.Errorf("got %d batches, expected 2", n)
+	}
+	if points := w.Points(); len(points) != 2 || points[0] != a || points[1] != b {
+		t.Errorf("got points %v, expected the written points in order", points)
+	}
+	found := w.Find(exportertest.PointMatcher{Tags: map[string]string{"host": "b"}})
+	if len(found) != 1 || found[0] != b {
+		t.Errorf("got points %v, expected the point of host b", found)
+	}
+
+	w.Reset()
+	if n := len(w.Points()); n != 0 {
+		t.Errorf("got %d points after reset", n)
+	}
+
+	// failed writes are not recorded.
+	w.Err = errors.New("connection refused")
+	if err := w.Write(newBatch(t, a)); err != w.Err {
+		t.Errorf("got %v, expected the writer error", err)
+	}
+	if n := len(w.Points()); n != 0 {
+		t.Errorf("got %d points recorded by a failed write", n)
+	}
+}
+
+func TestPointMatcher(t *testing.T) {
+	point := newPoint(t, map[string]string{"host": "a", "region": "eu"}, map[string]interface{}{
+		"user":  0.5,
+		"procs": int64(3),
+	})
+	tests := []struct {
+		about   string
+		matcher exportertest.PointMatcher
+		err     string
+	}{{
+		about: "match",
+		matcher: exportertest.PointMatcher{
+			Measurement: "cpu",
+			Tags:        map[string]string{"host": "a"},
+			Fields:      map[string]interface{}{"user": 0.5, "procs": int64(3)},
+		},
+	}, {
+		about:   "empty matcher",
+		matcher: exportertest.PointMatcher{},
+	}, {
+		about:   "measurement",
+		matcher: exportertest.PointMatcher{Measurement: "mem"},
+		err:     `measurement "cpu", expected "mem"`,
+	}, {
+		about:   "missing tag",
+		matcher: exportertest.PointMatcher{Tags: map[string]string{"zone": "a"}},
+		err:     `tag "zone" not found`,
+	}, {
+		about:   "tag value",
+		matcher: exportertest.PointMatcher{Tags: map[string]string{"host": "b"}},
+		err:     `tag "host" is "a", expected "b"`,
+	}, {
+		about:   "missing field",
+		matcher: exportertest.PointMatcher{Fields: map[string]interface{}{"system": 0.5}},
+		err:     `field "system" not found`,
+	}, {
+		about:   "field type",
+		matcher: exportertest.PointMatcher{Fields: map[string]interface{}{"procs": 3.0}},
+		err:     `field "procs" is 3 (int64), expected 3 (float64)`,
+	}}
+	for _, test := range tests {
+		t.Run(test.about, func(t *testing.T) {
+			err := test.matcher.Match(point)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, expected %q", err, test.err)
+			}
+		})
+	}
+	if err := (exportertest.PointMatcher{}).Match(nil); err == nil {
+		t.Error("expected an error matching a nil point")
+	}
+}
+
+func ExampleRecordingWriter() {
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"user": "number"},
+		TagFields: []string{"host"},
+	}
+	data := [][]byte{
+		[]byte(`{"host": "a", "user": 0.5}`),
+		[]byte(`{"host": "b", "user": 1.5}`),
+	}
+	w := &exportertest.RecordingWriter{}
+	e := &exporter.Exporter{}
+	if err := e.ProcessData(context.Background(), config, w, data, []time.Time{time.Unix(1, 0)}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	points := w.Find(exportertest.PointMatcher{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "b"},
+	})
+	fmt.Println(len(points))
+
+	err := exportertest.PointMatcher{
+		Fields: map[string]interface{}{"user": 1.5},
+	}.Match(points[0])
+	fmt.Println(err)
+	// Output:
+	// 1
+	// <nil>
+}
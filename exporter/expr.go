@@ -0,0 +1,218 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// expression is an arithmetic expression of ComputedFields.
+type expression interface {
+	// eval returns the value of the expression for the entry. The
+	// variables are resolved using the lookup function.
+	eval(lookup func(key string) (float64, error)) (float64, error)
+	// variables returns the entry keys used by the expression, in
+	// order of appearance.
+	variables() []string
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(func(string) (float64, error)) (float64, error) {
+	return float64(e), nil
+}
+
+func (e numberExpr) variables() []string {
+	return nil
+}
+
+type variableExpr string
+
+func (e variableExpr) eval(lookup func(string) (float64, error)) (float64, error) {
+	return lookup(string(e))
+}
+
+func (e variableExpr) variables() []string {
+	return []string{string(e)}
+}
+
+type negExpr struct {
+	x expression
+}
+
+func (e negExpr) eval(lookup func(string) (float64, error)) (float64, error) {
+	x, err := e.x.eval(lookup)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return -x, nil
+}
+
+func (e negExpr) variables() []string {
+	return e.x.variables()
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expression
+}
+
+func (e binaryExpr) eval(lookup func(string) (float64, error)) (float64, error) {
+	x, err := e.x.eval(lookup)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	y, err := e.y.eval(lookup)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	switch e.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	default:
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return x / y, nil
+	}
+}
+
+func (e binaryExpr) variables() []string {
+	return append(e.x.variables(), e.y.variables()...)
+}
+
+// parseExpression parses the arithmetic expression, which holds numbers,
+// entry keys, the +, -, * and / operators and parentheses, e.g.
+// "(used + cached) / total".
+func parseExpression(s string) (expression, error) {
+	p := &exprParser{s: s}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid expression %q", s)
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, errors.Errorf("invalid expression %q: unexpected %q", s, p.s[p.pos:])
+	}
+	return e, nil
+}
+
+// exprParser is a recursive descent parser of arithmetic expressions.
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space character, or 0 at the end of the
+// expression.
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// parseSum parses a sequence of terms separated by + or -.
+func (p *exprParser) parseSum() (expression, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+// parseProduct parses a sequence of factors separated by * or /.
+func (p *exprParser) parseProduct() (expression, error) {
+	x, err := p.parseFactor()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseFactor()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+// parseFactor parses a number, an entry key, a negated factor or a
+// parenthesized expression.
+func (p *exprParser) parseFactor() (expression, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '-':
+		p.pos++
+		x, err := p.parseFactor()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return negExpr{x: x}, nil
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if p.peek() != ')' {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return x, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && strings.IndexByte("0123456789.", p.s[p.pos]) >= 0 {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return numberExpr(f), nil
+	case isKeyChar(c):
+		start := p.pos
+		for p.pos < len(p.s) && isKeyChar(p.s[p.pos]) {
+			p.pos++
+		}
+		return variableExpr(p.s[start:p.pos]), nil
+	}
+	return nil, errors.Errorf("unexpected %q", c)
+}
+
+// isKeyChar returns true if the character may be part of an entry key
+// referenced by an expression, including dotted keys and array indexes.
+func isKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("_.[]", c) >= 0
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"testing"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+func TestComputedFields(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "mem",
+		Fields: map[string]string{"total": "number"},
+		ComputedFields: map[string]string{
+			"ratio":    "used / total",
+			"free":     "total - used - cache.size",
+			"weighted": "used + cache.size * 2",
+			"grouped":  "(used + cache.size) * 2",
+			"neg":      "-used / (total - 3)",
+			"scaled":   "used * 1.5 + 0.25",
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"used": 1, "cache": {"size": 2}, "total": 4}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// * and / take precedence over + and -, and - is left associative.
+	assertLines(t, got, "mem free=1,grouped=6,neg=-1,ratio=0.25,scaled=1.75,total=4,weighted=5 1000000000")
+}
+
+func TestComputedFieldsDivisionByZero(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "mem",
+		Fields: map[string]string{"total": "number"},
+		ComputedFields: map[string]string{
+			"ratio": "used / total",
+			"sum":   "used + total",
+			"other": "used / missing",
+		},
+	}
+	logger := &logRecorder{}
+	e := &exporter.Exporter{Logger: logger}
+	got, err := buildPoints(t, e, config, `{"used": 1, "total": 0}`)
+	// fields that cannot be computed are only logged and skipped, the
+	// other fields of the entry are written.
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "mem sum=1,total=0 1000000000")
+	if !logger.contains("cannot compute field ratio: division by zero") {
+		t.Errorf("division by zero not logged: %q", logger.msgs)
+	}
+	if !logger.contains("cannot compute field other: entry key not found: missing") {
+		t.Errorf("missing key not logged: %q", logger.msgs)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"bytes"
+	"os"
+	"sync"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/errors"
+)
+
+// FileWriter returns a writer appending the points to the file at the
+// given path in line protocol, one point per line, for running the
+// exporter without an influxdb server. The file is created if needed,
+// and is opened for each write, so that it may be moved or truncated
+// between writes. Concurrent writes are serialized.
+func FileWriter(path string) Writer {
+	return &fileWriter{path: path}
+}
+
+type fileWriter struct {
+	path string
+
+	mu sync.Mutex
+}
+
+// Write implements Writer.
+func (w *fileWriter) Write(bp client.BatchPoints) error {
+	var b bytes.Buffer
+	for _, point := range bp.Points() {
+		if point == nil {
+			continue
+		}
+		b.WriteString(point.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Annotate(err, "failed to open the output file")
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return errors.Annotate(err, "failed to write the points")
+	}
+	return errors.Annotate(f.Close(), "failed to close the output file")
+}
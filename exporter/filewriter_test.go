@@ -0,0 +1,88 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+func TestFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metamorphosis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "points.txt")
+	w := exporter.FileWriter(path)
+	e := newExporter(t)
+	e.BatchSize = 2
+	if err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(3), []time.Time{epoch}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the points are written with the precision of the topic.
+	expected := "cpu a=1 1000\ncpu a=2 1000\ncpu a=3 1000\n"
+	if string(data) != expected {
+		t.Errorf("got file contents %q, expected %q", data, expected)
+	}
+}
+
+func TestFileWriterConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metamorphosis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "points.txt")
+	w := exporter.FileWriter(path)
+	bp, err := newExporter(t).BuildPoints(numberConfig, numberEntries(100), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.Write(bp); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the batches are not interleaved.
+	batch := bp.Points()[0].PrecisionString("ms") + "\n"
+	for _, point := range bp.Points()[1:] {
+		batch += point.PrecisionString("ms") + "\n"
+	}
+	if string(data) != strings.Repeat(batch, 10) {
+		t.Errorf("got interleaved batches %q", data)
+	}
+}
+
+func TestFileWriterError(t *testing.T) {
+	w := exporter.FileWriter(filepath.Join("no", "such", "dir", "points.txt"))
+	bp, err := newExporter(t).BuildPoints(numberConfig, numberEntries(1), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(bp); err == nil || !strings.Contains(err.Error(), "failed to open the output file") {
+		t.Errorf("got %v, expected an open error", err)
+	}
+}
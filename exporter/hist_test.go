@@ -0,0 +1,224 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+// histConfig returns the config of a topic with the "h" histogram
+// field.
+func histConfig() exporter.TopicConfig {
+	return exporter.TopicConfig{
+		Topic:  "test-topic",
+		Fields: map[string]string{"h": "hist"},
+	}
+}
+
+func TestHistBucketArray(t *testing.T) {
+	config := histConfig()
+	config.BucketArray = true
+	config.KeyFormat = "%04d"
+	got, err := buildPoints(t, newExporter(t), config, `{"h": [{"le": 10, "count": 20}, {"le": 5, "count": 1}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic 0005=1,0010=20 1000000000")
+
+	config.BucketKey = "bound"
+	config.CountKey = "n"
+	got, err = buildPoints(t, newExporter(t), config, `{"h": [{"bound": 10, "n": 20}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic 0010=20 1000000000")
+}
+
+func TestHistCollisionMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected []string
+	}{
+		{"", []string{"test-topic 2=3 1000000000"}},
+		{"last", []string{"test-topic 2=3 1000000000"}},
+		{"sum", []string{"test-topic 2=4 1000000000"}},
+		{"error", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			config := histConfig()
+			config.KeyFormat = "%.0f"
+			config.CollisionMode = test.mode
+			got, err := buildPoints(t, newExporter(t), config, `{"h": {"2.2": 3, "1.6": 1}}`)
+			if test.mode == "error" {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			assertLines(t, got, test.expected...)
+		})
+	}
+}
+
+func TestHistGzip(t *testing.T) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write([]byte(`{"h": {"10": 20, "0": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config := histConfig()
+	config.Compression = "gzip"
+	bp, err := newExporter(t).BuildPoints(config, [][]byte{b.Bytes()}, []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(bp.Points()), "test-topic 0=1,10=20 1000000000")
+
+	_, err = buildPoints(t, newExporter(t), config, `{"h": {"10": 20}}`)
+	if err == nil || !strings.Contains(err.Error(), "failed to decompress") {
+		t.Errorf("got %v, expected a decompression error for an uncompressed entry", err)
+	}
+}
+
+func TestHistFractionalCounts(t *testing.T) {
+	config := histConfig()
+	config.KeyFormat = "%04d"
+	got, err := buildPoints(t, newExporter(t), config, `{"h": {"10": 2.5, "20": 0.25}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the boundaries are formatted, the counts are kept.
+	assertLines(t, got, "test-topic 0010=2.5,0020=0.25 1000000000")
+}
+
+func TestHistFractionalBoundaries(t *testing.T) {
+	config := histConfig()
+	config.KeyFormat = "b%04d"
+	got, err := buildPoints(t, newExporter(t), config, `{"h": {"0.5": 1, "1e3": 2, "20": 3}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// integer verbs format fractional boundaries as %v.
+	assertLines(t, got, "test-topic b0.5=1,b0020=3,b1000=2 1000000000")
+}
+
+func TestHistStableOrder(t *testing.T) {
+	config := histConfig()
+	// the line protocol does not depend on the iteration order of the
+	// buckets.
+	for i := 0; i < 20; i++ {
+		got, err := buildPoints(t, newExporter(t), config, `{"h": {"20": 5, "0": 1, "10": 20, "5": 2, "15": 3}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertLines(t, got, "test-topic 0=1,10=20,15=3,20=5,5=2 1000000000")
+	}
+
+	// the buckets are processed in numeric order of their boundaries,
+	// which differs from their lexicographic order, as told by the
+	// order in which the buckets below the min value are skipped.
+	logger := &logRecorder{}
+	config.MinValue = 100
+	_, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"h": {"10": 1, "2": 1, "9.5": 1, "100": 1, "20": 100}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var skipped []string
+	for _, msg := range logger.msgs {
+		if strings.HasPrefix(msg, "skipping ") {
+			skipped = append(skipped, strings.Fields(msg)[1])
+		}
+	}
+	if strings.Join(skipped, " ") != "h.2 h.9.5 h.10 h.100" {
+		t.Errorf("got buckets skipped in order %v, expected h.2, h.9.5, h.10 and h.100", skipped)
+	}
+}
+
+func TestHistInvalidCount(t *testing.T) {
+	config := histConfig()
+	logger := &logRecorder{}
+	got, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"h": {"0": 1, "10": "many", "20": 3}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+		t.Errorf("got %q, expected a field type mismatch error", logger.msgs)
+	}
+	// the other buckets are still written.
+	assertLines(t, got, "test-topic 0=1,20=3 1000000000")
+}
+
+func TestHistMinValue(t *testing.T) {
+	config := histConfig()
+	config.MinValue = 1
+	got, err := buildPoints(t, newExporter(t), config, `{"h": {"0": 0, "10": 20}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic 10=20 1000000000")
+}
+
+func TestHistKeyTransform(t *testing.T) {
+	config := histConfig()
+	config.KeyTransform = "le"
+	got, err := buildPoints(t, newExporter(t), config, `{"h": {"+Inf": 3, "0.5": 1, "10": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, `test-topic le\=+Inf=3,le\=0.5=1,le\=10=2 1000000000`)
+	fields, err := parseLine(t, got[0]).Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["le=+Inf"] != 3.0 {
+		t.Errorf("got fields %v, expected the le=+Inf bucket", fields)
+	}
+
+	config.KeyFormat = "bucket_%s"
+	got, err = buildPoints(t, newExporter(t), config, `{"h": {"+Inf": 3, "10": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, `test-topic bucket_le\=+Inf=3,bucket_le\=10=2 1000000000`)
+
+	// 1000 and 1024 both map to the 2^10 bucket, whose last value is
+	// kept.
+	config.KeyTransform = "log2bucket"
+	config.KeyFormat = ""
+	got, err = buildPoints(t, newExporter(t), config, `{"h": {"1000": 3, "1024": 1, "3": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic 2^10=1,2^2=2 1000000000")
+}
+
+func TestHistBucketFill(t *testing.T) {
+	config := histConfig()
+	config.BucketMax = 20
+	config.BucketStep = 10
+	got, err := buildPoints(t, newExporter(t), config, `{"h": {"10": 20}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic 0=0,10=20,20=0 1000000000")
+
+	// the filled buckets are formatted as the others, and buckets out
+	// of the range are kept.
+	config.KeyFormat = "%03d"
+	got, err = buildPoints(t, newExporter(t), config, `{"h": {"10": 20, "30": 1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic 000=0,010=20,020=0,030=1 1000000000")
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/errors"
+)
+
+// NewInfluxDBClient returns an influxdb v1 HTTP client as created by
+// client.NewHTTPClient, whose writes rejected by the server fail with a
+// WriteError holding the status of the response, so that the exporter
+// can tell the rejected writes from the failed ones.
+func NewInfluxDBClient(config client.HTTPConfig) (client.Client, error) {
+	c, err := client.NewHTTPClient(config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the address was checked by client.NewHTTPClient.
+	u, _ := url.Parse(config.Addr)
+	u.Path = path.Join(u.Path, "write")
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		},
+		Proxy: config.Proxy,
+	}
+	if config.TLSConfig != nil {
+		tr.TLSClientConfig = config.TLSConfig
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = "InfluxDBClient"
+	}
+	return &influxDBClient{
+		Client:   c,
+		config:   config,
+		writeURL: u,
+		httpClient: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: tr,
+		},
+	}, nil
+}
+
+type influxDBClient struct {
+	client.Client
+	config     client.HTTPConfig
+	writeURL   *url.URL
+	httpClient *http.Client
+}
+
+// Write implements client.Client.
+func (c *influxDBClient) Write(bp client.BatchPoints) error {
+	var b bytes.Buffer
+	for _, point := range bp.Points() {
+		if point == nil {
+			continue
+		}
+		b.WriteString(point.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+
+	u := *c.writeURL
+	params := url.Values{}
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	params.Set("consistency", bp.WriteConsistency())
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &b)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "")
+	req.Header.Set("User-Agent", c.config.UserAgent)
+	if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return errors.Trace(&WriteError{
+			StatusCode: resp.StatusCode,
+			Message:    responseError(body),
+		})
+	}
+	return nil
+}
+
+// responseError returns the error message of the body of a failed
+// response, which influxdb sends as {"error": "message"}, so that e.g.
+// field type conflicts can be parsed from the message. The body is
+// returned as is if it holds no such message.
+func responseError(body []byte) string {
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error == "" {
+		return string(body)
+	}
+	return resp.Error
+}
+
+// Close implements client.Client.
+func (c *influxDBClient) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return errors.Trace(c.Client.Close())
+}
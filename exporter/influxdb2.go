@@ -0,0 +1,112 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/errors"
+)
+
+// InfluxDB2Config holds the configuration of a writer writing points
+// to the write API of InfluxDB 2.x.
+type InfluxDB2Config struct {
+	// URL holds the address of the InfluxDB server, e.g.
+	// "http://localhost:8086".
+	URL string `yaml:"url"`
+	// Org holds the name of the organization owning the bucket.
+	Org string `yaml:"org"`
+	// Bucket holds the name of the bucket the points are written
+	// to. If not set, the database of the batch of points is used.
+	Bucket string `yaml:"bucket,omitempty"`
+	// Token holds the API token used to authenticate the writes.
+	Token string `yaml:"token"`
+
+	// HTTPClient, if set, is used to send the requests. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client `yaml:"-"`
+}
+
+type influxDB2Writer struct {
+	config   InfluxDB2Config
+	writeURL *url.URL
+}
+
+// NewInfluxDB2Writer returns a writer writing points to the write API of
+// InfluxDB 2.x. The points are built as for InfluxDB 1.x and sent in
+// line protocol.
+func NewInfluxDB2Writer(config InfluxDB2Config) (Writer, error) {
+	if config.URL == "" {
+		return nil, errors.New("influxdb url not specified")
+	}
+	if config.Org == "" {
+		return nil, errors.New("influxdb organization not specified")
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, errors.Annotate(err, "invalid influxdb url")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &influxDB2Writer{
+		config:   config,
+		writeURL: u,
+	}, nil
+}
+
+// Write implements the Writer interface.
+func (w *influxDB2Writer) Write(bp client.BatchPoints) error {
+	var b bytes.Buffer
+	for _, point := range bp.Points() {
+		if point == nil {
+			continue
+		}
+		b.WriteString(point.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+
+	bucket := w.config.Bucket
+	if bucket == "" {
+		bucket = bp.Database()
+		if bp.RetentionPolicy() != "" {
+			bucket += "/" + bp.RetentionPolicy()
+		}
+	}
+	u := *w.writeURL
+	params := url.Values{}
+	params.Set("org", w.config.Org)
+	params.Set("bucket", bucket)
+	params.Set("precision", bp.Precision())
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &b)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.config.Token)
+	}
+
+	resp, err := w.config.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Trace(&WriteError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("influxdb write failed with status %s: %s", resp.Status, body),
+		})
+	}
+	return nil
+}
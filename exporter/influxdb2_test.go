@@ -0,0 +1,113 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+// writeRequest holds the parts of a write request received by a stub
+// server.
+type writeRequest struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   string
+}
+
+// stubServer returns a server recording the requests it receives on the
+// channel and replying with the given status.
+func stubServer(status int) (*httptest.Server, <-chan writeRequest) {
+	requests := make(chan writeRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- writeRequest{
+			method: req.Method,
+			path:   req.URL.Path,
+			query:  req.URL.RawQuery,
+			header: req.Header,
+			body:   string(body),
+		}
+		w.WriteHeader(status)
+	}))
+	return srv, requests
+}
+
+func TestInfluxDB2Writer(t *testing.T) {
+	srv, requests := stubServer(http.StatusNoContent)
+	defer srv.Close()
+	w, err := exporter.NewInfluxDB2Writer(exporter.InfluxDB2Config{
+		URL:   srv.URL,
+		Org:   "acme",
+		Token: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := exporter.TopicConfig{
+		Topic:           "cpu",
+		Fields:          map[string]string{"a": "number", "s": "string"},
+		Database:        "metrics",
+		RetentionPolicy: "week",
+		Precision:       "s",
+	}
+	err = newExporter(t).ProcessData(context.Background(), config, w, entries(`{"a": 1, "s": "x"}`, `{"a": 2, "s": "y"}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != "POST" || req.path != "/api/v2/write" {
+		t.Errorf("got %s %s", req.method, req.path)
+	}
+	if req.query != "bucket=metrics%2Fweek&org=acme&precision=s" {
+		t.Errorf("got query %q", req.query)
+	}
+	if auth := req.header.Get("Authorization"); auth != "Token secret" {
+		t.Errorf("got authorization %q", auth)
+	}
+	if req.body != "cpu a=1,s=\"x\" 1\ncpu a=2,s=\"y\" 1\n" {
+		t.Errorf("got body %q", req.body)
+	}
+}
+
+func TestInfluxDB2WriterError(t *testing.T) {
+	srv, requests := stubServer(http.StatusUnauthorized)
+	defer srv.Close()
+	w, err := exporter.NewInfluxDB2Writer(exporter.InfluxDB2Config{
+		URL:    srv.URL,
+		Org:    "acme",
+		Bucket: "b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newExporter(t).ProcessData(context.Background(), numberConfig, w, numberEntries(1), []time.Time{epoch})
+	if err == nil || !strings.Contains(err.Error(), "influxdb write failed with status 401") {
+		t.Errorf("got %v, expected the write to fail", err)
+	}
+	req := <-requests
+	if req.query != "bucket=b&org=acme&precision=ms" {
+		t.Errorf("got query %q", req.query)
+	}
+	if auth := req.header.Get("Authorization"); auth != "" {
+		t.Errorf("got authorization %q without a token", auth)
+	}
+}
+
+func TestNewInfluxDB2WriterErrors(t *testing.T) {
+	if _, err := exporter.NewInfluxDB2Writer(exporter.InfluxDB2Config{Org: "acme"}); err == nil {
+		t.Errorf("expected an error without url")
+	}
+	if _, err := exporter.NewInfluxDB2Writer(exporter.InfluxDB2Config{URL: "http://localhost:8086"}); err == nil {
+		t.Errorf("expected an error without organization")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/errors"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+func TestInfluxDBClient(t *testing.T) {
+	srv, requests := stubServer(http.StatusNoContent)
+	defer srv.Close()
+	c, err := exporter.NewInfluxDBClient(client.HTTPConfig{
+		Addr:     srv.URL,
+		Username: "admin",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	config := exporter.TopicConfig{
+		Topic:           "cpu",
+		Fields:          map[string]string{"a": "number"},
+		Database:        "metrics",
+		RetentionPolicy: "week",
+		Precision:       "s",
+	}
+	err = newExporter(t).ProcessData(context.Background(), config, c, entries(`{"a": 1}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != "POST" || req.path != "/write" {
+		t.Errorf("got %s %s", req.method, req.path)
+	}
+	if req.query != "consistency=&db=metrics&precision=s&rp=week" {
+		t.Errorf("got query %q", req.query)
+	}
+	if user, password, ok := (&http.Request{Header: req.header}).BasicAuth(); !ok || user != "admin" || password != "secret" {
+		t.Errorf("got basic auth %q %q", user, password)
+	}
+	if req.body != "cpu a=1 1\n" {
+		t.Errorf("got body %q", req.body)
+	}
+}
+
+func TestInfluxDBClientError(t *testing.T) {
+	srv, _ := stubServer(http.StatusBadRequest)
+	defer srv.Close()
+	c, err := exporter.NewInfluxDBClient(client.HTTPConfig{Addr: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	bp, err := newExporter(t).BuildPoints(numberConfig, numberEntries(1), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Write(bp)
+	if werr, ok := errors.Cause(err).(*exporter.WriteError); !ok || werr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %#v, expected a write error with status 400", err)
+	}
+}
@@ -0,0 +1,2258 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// Exporter converts the data consumed from kafka topics into influxdb
+// points.
+type Exporter struct {
+	// BatchSize holds the maximum number of points written to
+	// influxdb in a single request. If zero, all points of a
+	// ProcessData call are written in a single request.
+	BatchSize int
+
+	// Retry specifies how failed writes are retried.
+	Retry RetryConfig
+
+	// DryRun specifies that the points are logged in line protocol
+	// rather than written.
+	DryRun bool
+
+	// MeasurementPrefix and MeasurementSuffix hold the strings
+	// prepended and appended to the names of all written
+	// measurements, including those set by the topic Measurement and
+	// SubMeasurements, e.g. "_prod".
+	MeasurementPrefix string
+	MeasurementSuffix string
+
+	// PointsPerSecond, if positive, holds the maximum rate at which
+	// points are written.
+	PointsPerSecond float64
+
+	// Transform, if set, is called with each point before it is
+	// written, and returns the point to write in its place. If it
+	// returns nil, the point is dropped. If it returns an error, no
+	// points are written and the error is returned.
+	Transform func(*client.Point) (*client.Point, error)
+
+	// Rand, if set, returns the pseudo-random numbers in [0, 1) used
+	// to sample the entries of topics with a SampleRate. It must be
+	// safe for concurrent use. Defaults to rand.Float64.
+	Rand func() float64
+
+	// Clock, if set, provides the current time used to drop points
+	// older than the MaxAge of the topic. Defaults to the wall clock.
+	Clock clock.Clock
+
+	// Logger, if set, is used to log messages. Defaults to the
+	// standard logger.
+	Logger Logger
+
+	// muCounters protects counters, which holds the last seen value
+	// of each counter keyed by topic, field and series, as returned
+	// by counterKey.
+	muCounters sync.Mutex
+	counters   map[string]float64
+
+	// muLimiter protects limiter, which limits the rate of written
+	// points when PointsPerSecond is set.
+	muLimiter sync.Mutex
+	limiter   *rateLimiter
+
+	// muStats protects stats, which holds the processing statistics
+	// keyed by topic.
+	muStats sync.Mutex
+	stats   map[string]TopicStats
+}
+
+// Logger is the interface used by the exporter to log messages.
+type Logger interface {
+	// Printf logs a message formatted as by fmt.Printf.
+	Printf(format string, args ...interface{})
+}
+
+func (e *Exporter) logf(format string, args ...interface{}) {
+	if e.Logger != nil {
+		e.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// now returns the current time of the exporter's clock.
+func (e *Exporter) now() time.Time {
+	return e.clock().Now()
+}
+
+// clock returns the exporter's clock.
+func (e *Exporter) clock() clock.Clock {
+	if e.Clock == nil {
+		return clock.WallClock
+	}
+	return e.Clock
+}
+
+// random returns a pseudo-random number in [0, 1).
+func (e *Exporter) random() float64 {
+	if e.Rand == nil {
+		return rand.Float64()
+	}
+	return e.Rand()
+}
+
+// TopicStats holds the statistics of the entries processed for a topic.
+type TopicStats struct {
+	// PointsWritten holds the number of points written, not counting
+	// the heartbeat points.
+	PointsWritten int64
+	// EntriesFiltered holds the number of entries skipped because
+	// they did not match the topic filter.
+	EntriesFiltered int64
+	// UnmarshalErrors holds the number of entries that could not be
+	// unmarshaled.
+	UnmarshalErrors int64
+	// MissingKeys holds the number of configured keys that were not
+	// found in the entries.
+	MissingKeys int64
+	// InvalidValues holds the number of entry values skipped because
+	// they could not be converted to their field type.
+	InvalidValues int64
+	// UndeclaredKeys holds the number of entry keys not declared in
+	// the config of a topic with StrictFields.
+	UndeclaredKeys int64
+	// WriteLatency holds the durations of the successful writes.
+	WriteLatency LatencyHistogram
+	// FailedWriteLatency holds the durations of the failed writes.
+	FailedWriteLatency LatencyHistogram
+}
+
+// latencyBuckets holds the upper bounds of the buckets of latency
+// histograms.
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram holds the distribution of observed durations.
+type LatencyHistogram struct {
+	// Counts holds the number of durations observed in each bucket:
+	// Counts[i] holds the number of durations not greater than the
+	// i-th bucket bound (10ms, 50ms, 100ms, 500ms, 1s, 5s and 10s)
+	// and greater than the previous one, and the last count holds
+	// the number of durations greater than 10s.
+	Counts [8]int64
+	// Count holds the number of observed durations.
+	Count int64
+	// Sum holds the sum of the observed durations.
+	Sum time.Duration
+}
+
+// observe adds the duration to the histogram.
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return d <= latencyBuckets[i]
+	})
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h *LatencyHistogram) add(other LatencyHistogram) {
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+}
+
+func (s *TopicStats) add(other TopicStats) {
+	s.PointsWritten += other.PointsWritten
+	s.EntriesFiltered += other.EntriesFiltered
+	s.UnmarshalErrors += other.UnmarshalErrors
+	s.MissingKeys += other.MissingKeys
+	s.InvalidValues += other.InvalidValues
+	s.UndeclaredKeys += other.UndeclaredKeys
+	s.WriteLatency.add(other.WriteLatency)
+	s.FailedWriteLatency.add(other.FailedWriteLatency)
+}
+
+// Stats returns the statistics of the entries processed by the exporter
+// keyed by topic.
+func (e *Exporter) Stats() map[string]TopicStats {
+	e.muStats.Lock()
+	defer e.muStats.Unlock()
+	stats := make(map[string]TopicStats, len(e.stats))
+	for topic, topicStats := range e.stats {
+		stats[topic] = topicStats
+	}
+	return stats
+}
+
+func (e *Exporter) addStats(topic string, stats TopicStats) {
+	e.muStats.Lock()
+	defer e.muStats.Unlock()
+	if e.stats == nil {
+		e.stats = make(map[string]TopicStats)
+	}
+	topicStats := e.stats[topic]
+	topicStats.add(stats)
+	e.stats[topic] = topicStats
+}
+
+// processor converts the entries of a single ProcessData call into
+// points.
+type processor struct {
+	*TopicConfig
+
+	exporter *Exporter
+	stats    TopicStats
+
+	// seen holds the values of the dedup key of the processed
+	// entries.
+	seen map[string]bool
+
+	// sets holds the distinct values of set entries keyed by series.
+	sets map[string]*valueSet
+
+	// staticTags holds the tags of all points: the static tags of
+	// the topic and the tags extracted from the topic name.
+	staticTags map[string]string
+
+	// expressions holds the parsed expressions of the computed
+	// fields.
+	expressions map[string]expression
+
+	// index holds the index of the entry being processed.
+	index int
+
+	// counters, if set, holds the previous values of counters, used
+	// in place of those of the exporter.
+	counters map[string]float64
+}
+
+// valueSet holds the distinct values seen for a series of a set topic.
+type valueSet struct {
+	tags      map[string]string
+	values    map[string]bool
+	timestamp time.Time
+}
+
+func (p *processor) logf(format string, args ...interface{}) {
+	p.exporter.logf(format, args...)
+}
+
+// measurementName returns the name of the written measurement, with the
+// exporter's measurement prefix and suffix.
+func (p *processor) measurementName(measurement string) string {
+	return p.exporter.MeasurementPrefix + measurement + p.exporter.MeasurementSuffix
+}
+
+// missingKey records that the entry key was not found.
+func (p *processor) missingKey(key string) {
+	p.addEntryError(p.entryError(ErrMissingKey, key, nil))
+	p.stats.MissingKeys++
+}
+
+// invalidValue records that the value of the entry key could not be
+// converted to the given type.
+func (p *processor) invalidValue(valueType string, value interface{}, key string) {
+	p.addEntryError(p.entryError(ErrFieldTypeMismatch, key, errors.Errorf("invalid %s value %v", valueType, value)))
+	p.stats.InvalidValues++
+}
+
+// addEntryError logs the error of the entry being processed. The entry
+// is still written, so the error is not returned in the ProcessErrors of
+// the call, which only hold the entries that could not be written.
+func (p *processor) addEntryError(err *EntryError) {
+	p.logf("%v", err)
+}
+
+// ProcessData converts the data consumed from a kafka topic into
+// influxdb points, as specified by the topic config, and writes them
+// using the writer. The timestamps hold the time of each entry, or a
+// single time applying to all entries.
+func (e *Exporter) ProcessData(ctx context.Context, config TopicConfig, writer Writer, data [][]byte, timestamps []time.Time) error {
+	return e.ProcessDataWithKeys(ctx, config, writer, nil, data, timestamps)
+}
+
+// ProcessDataWithKeys is like ProcessData, but also receives the keys of
+// the kafka messages holding the data, which are written as the KeyTag
+// of the topic config. The keys may be nil, otherwise there must be a
+// key for each entry.
+func (e *Exporter) ProcessDataWithKeys(ctx context.Context, config TopicConfig, writer Writer, keys [][]byte, data [][]byte, timestamps []time.Time) error {
+	return e.ProcessDataWithHeaders(ctx, config, writer, keys, nil, data, timestamps)
+}
+
+// ProcessDataWithHeaders is like ProcessDataWithKeys, but also receives
+// the headers of the kafka messages holding the data, which are written
+// as the HeaderTags of the topic config. The headers may be nil,
+// otherwise there must be a map of headers for each entry.
+func (e *Exporter) ProcessDataWithHeaders(ctx context.Context, config TopicConfig, writer Writer, keys [][]byte, headers []map[string][]byte, data [][]byte, timestamps []time.Time) error {
+	p := e.newProcessor(&config)
+	defer p.close()
+
+	bp, err := p.buildPoints(ctx, keys, headers, data, timestamps, func(points []*client.Point) error {
+		return p.write(ctx, writer, points)
+	})
+	if processError, ok := err.(ProcessError); ok {
+		// the OnError policy of the topic is "fail"
+		if err := p.writeHeartbeat(ctx, writer, len(data), 1); err != nil {
+			return errors.Trace(err)
+		}
+		return processError
+	}
+	processErrors, ok := err.(ProcessErrors)
+	if err != nil && !ok {
+		p.writeFailureHeartbeat(ctx, writer, len(data), 1)
+		return errors.Trace(err)
+	}
+	if err := p.write(ctx, writer, bp.Points()); err != nil {
+		p.writeFailureHeartbeat(ctx, writer, len(data), processErrors.entries()+1)
+		return errors.Trace(err)
+	}
+	if err := p.writeHeartbeat(ctx, writer, len(data), processErrors.entries()); err != nil {
+		return errors.Trace(err)
+	}
+	if len(processErrors) > 0 {
+		return processErrors
+	}
+	return nil
+}
+
+// writeHeartbeat writes the heartbeat point of the ProcessData call, if
+// the topic specifies a heartbeat measurement.
+func (p *processor) writeHeartbeat(ctx context.Context, writer Writer, entries, errorCount int) error {
+	if p.Heartbeat == "" {
+		return nil
+	}
+	point, err := client.NewPoint(
+		p.measurementName(p.Heartbeat),
+		map[string]string{"topic": p.Topic},
+		map[string]interface{}{
+			"entries": int64(entries),
+			"points":  p.stats.PointsWritten,
+			"errors":  int64(errorCount),
+		},
+		p.exporter.now(),
+	)
+	if err != nil {
+		return errors.Annotate(err, "failed to create the heartbeat point")
+	}
+	// the heartbeat point is not counted in the points written for
+	// the topic.
+	pointsWritten := p.stats.PointsWritten
+	err = p.write(ctx, writer, []*client.Point{point})
+	p.stats.PointsWritten = pointsWritten
+	return errors.Trace(err)
+}
+
+// writeFailureHeartbeat writes the heartbeat point of a ProcessData call
+// failing with an error, which counts as one of the errors. The failure
+// to write the heartbeat point, e.g. because the writer is failing, is
+// only logged, so that the error of the call is returned.
+func (p *processor) writeFailureHeartbeat(ctx context.Context, writer Writer, entries, errorCount int) {
+	if err := p.writeHeartbeat(ctx, writer, entries, errorCount); err != nil {
+		p.logf("failed to write the heartbeat point: %v", err)
+	}
+}
+
+// BuildPoints converts the data consumed from a kafka topic into influxdb
+// points, as specified by the topic config, without writing them. If
+// some of the entries could not be processed, the batch holding the
+// points of the remaining entries is returned along with ProcessErrors,
+// or only the ProcessError of the first entry if the OnError policy of
+// the topic is "fail".
+//
+// BuildPoints does not change the state of the exporter: the previous
+// values of counters are only those seen in the data, and the
+// statistics returned by Stats are not updated.
+func (e *Exporter) BuildPoints(config TopicConfig, data [][]byte, timestamps []time.Time) (client.BatchPoints, error) {
+	p := e.newProcessor(&config)
+	p.counters = make(map[string]float64)
+	return p.buildPoints(context.Background(), nil, nil, data, timestamps, nil)
+}
+
+func (e *Exporter) newProcessor(config *TopicConfig) *processor {
+	return &processor{
+		TopicConfig: config,
+		exporter:    e,
+	}
+}
+
+// close adds the statistics of the processor to the exporter's.
+func (p *processor) close() {
+	p.exporter.addStats(p.Topic, p.stats)
+}
+
+// buildPoints returns the batch of points created from the data and the
+// optional message keys and headers. It stops processing the entries when the
+// context is canceled.
+//
+// If the flush function is not nil and the topic specifies
+// MaxPointsPerCall, the points are passed to the flush function
+// whenever at least that many points are created, and only the remaining
+// points are returned, unless the topic fails on errors, so that no points are
+// written when an entry cannot be processed.
+func (p *processor) buildPoints(ctx context.Context, keys [][]byte, headers []map[string][]byte, data [][]byte, timestamps []time.Time, flush func([]*client.Point) error) (client.BatchPoints, error) {
+	if err := p.Validate(); err != nil {
+		return nil, errors.Annotate(err, "invalid topic config")
+	}
+	// a single timestamp applies to all entries
+	if len(timestamps) != len(data) && len(timestamps) != 1 {
+		return nil, errors.Errorf("got %d timestamps for %d entries", len(timestamps), len(data))
+	}
+	if keys != nil && len(keys) != len(data) {
+		return nil, errors.Errorf("got %d keys for %d entries", len(keys), len(data))
+	}
+	if headers != nil && len(headers) != len(data) {
+		return nil, errors.Errorf("got %d headers for %d entries", len(headers), len(data))
+	}
+	p.staticTags = p.topicTags()
+
+	var points []*client.Point
+	var processErrors ProcessErrors
+	for i, datum := range data {
+		p.index = i
+		select {
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		default:
+		}
+		payload, err := p.decompress(datum)
+		if err != nil {
+			p.logf("failed to decompress a data point: %v", err)
+			processErrors.add(i, datum, errors.Annotate(err, "failed to decompress a data point"))
+			if p.OnError == "fail" {
+				return nil, processErrors[0]
+			}
+			continue
+		}
+		entries, err := p.unmarshal(payload)
+		if err != nil {
+			p.logf("failed to unmarshal a data point: %v", err)
+			p.stats.UnmarshalErrors++
+			processErrors.add(i, datum, p.entryError(ErrUnmarshal, "", err))
+			if p.OnError == "fail" {
+				return nil, processErrors[0]
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if p.Root != "" {
+				var ok bool
+				if entry, ok = p.root(entry); !ok {
+					continue
+				}
+			}
+			if !p.Filter.matches(entry) {
+				p.stats.EntriesFiltered++
+				continue
+			}
+			if p.isDuplicate(entry) {
+				continue
+			}
+			if p.SampleRate > 0 && p.exporter.random() >= p.SampleRate {
+				continue
+			}
+			msg := message{
+				payload: payload,
+				time:    timestampAt(timestamps, i),
+			}
+			if keys != nil {
+				msg.key = keys[i]
+			}
+			if headers != nil {
+				msg.headers = headers[i]
+			}
+			entryPoints, err := p.safePoints(entry, msg)
+			if err != nil {
+				p.logf("failed to process a data point: %v", err)
+				processErrors.add(i, datum, errors.Trace(err))
+				if p.OnError == "fail" {
+					return nil, processErrors[0]
+				}
+				continue
+			}
+			points = append(points, entryPoints...)
+			// check the limit after each entry, not each datum, as a
+			// single array payload may hold any number of entries.
+			if flush != nil && p.MaxPointsPerCall > 0 && p.OnError != "fail" && len(points) >= p.MaxPointsPerCall {
+				points, err = p.finishPoints(points)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				if err := flush(points); err != nil {
+					return nil, errors.Trace(err)
+				}
+				points = nil
+			}
+		}
+	}
+	setPoints, err := p.setPoints()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	points = append(points, setPoints...)
+	points, err = p.finishPoints(points)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bp, err := p.newBatchPoints()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	bp.AddPoints(points)
+	if len(processErrors) > 0 {
+		return bp, processErrors
+	}
+	return bp, nil
+}
+
+// root returns the object stored under the Root key of the entry, which
+// the points are created from. Entries without the object are logged and
+// skipped.
+func (p *processor) root(entry map[string]interface{}) (map[string]interface{}, bool) {
+	value, ok := lookup(entry, p.Root)
+	if !ok {
+		p.missingKey(p.Root)
+		return nil, false
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		p.invalidValue("object", value, p.Root)
+		return nil, false
+	}
+	return object, true
+}
+
+// finishPoints returns the points to write, once the points of the
+// entries are created: merged, transformed, deduplicated and sorted as
+// specified by the topic config and the exporter.
+func (p *processor) finishPoints(points []*client.Point) ([]*client.Point, error) {
+	var err error
+	if p.MergeBuckets {
+		points, err = mergePoints(points, p.TraceTagField)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if p.exporter.Transform != nil {
+		points, err = p.transformPoints(points)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if p.DedupPoints {
+		points = p.dedupPoints(points)
+	}
+	if p.SortByTime {
+		sort.SliceStable(points, func(i, j int) bool {
+			return points[i].Time().Before(points[j].Time())
+		})
+	}
+	return points, nil
+}
+
+// newBatchPoints returns an empty batch of points to be written to the
+// database of the topic.
+func (p *processor) newBatchPoints() (client.BatchPoints, error) {
+	bp, err := client.NewBatchPoints(
+		client.BatchPointsConfig{
+			Database:         p.database(),
+			RetentionPolicy:  p.RetentionPolicy,
+			Precision:        p.precision(),
+			WriteConsistency: p.WriteConsistency,
+		},
+	)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to create a batch of points")
+	}
+	return bp, nil
+}
+
+// decompress returns the decompressed entry data.
+func (p *processor) decompress(data []byte) ([]byte, error) {
+	if p.Compression != "gzip" {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return payload, nil
+}
+
+// message holds the data of the kafka message an entry was read from.
+type message struct {
+	// key holds the message key, if any.
+	key []byte
+	// headers holds the message headers, if any.
+	headers map[string][]byte
+	// payload holds the decompressed message value.
+	payload []byte
+	// time holds the message time, used as the point time unless
+	// the entry holds a timestamp field.
+	time time.Time
+}
+
+// points returns the points created from the entry: the point of the
+// topic measurement, unless only sub-measurements are configured, and a
+// point for each sub-measurement.
+//
+// Measurement names, tag keys and values and field keys are escaped by
+// client.NewPoint, so they may contain spaces, commas and equal signs.
+func (p *processor) points(entry map[string]interface{}, msg message) ([]*client.Point, error) {
+	tags, ok := p.tags(entry)
+	if !ok {
+		return nil, nil
+	}
+	if p.KeyTag != "" && len(msg.key) > 0 {
+		tags = withTag(tags, p.KeyTag, string(msg.key))
+	}
+	for _, name := range p.HeaderTags {
+		if value := msg.headers[name]; len(value) > 0 {
+			tags = withTag(tags, name, string(value))
+		}
+	}
+	// the trace tag is only added to the created points, so that it
+	// does not change the series of counters and sets.
+	pointTags := tags
+	if value, ok := p.traceTag(entry); ok {
+		pointTags = withTag(tags, p.TraceTagField, value)
+	}
+	timestamp := p.timestamp(entry, msg.time)
+	if p.MaxAge > 0 && p.exporter.now().Sub(timestamp) > p.MaxAge {
+		p.logf("skipping entry with timestamp %v older than %v", timestamp, p.MaxAge)
+		return nil, nil
+	}
+	if p.TimeBucket > 0 {
+		timestamp = timestamp.Truncate(p.TimeBucket)
+	}
+	if p.Type == "set" {
+		// set points are created once all entries are processed
+		p.addToSet(tags, entry, timestamp)
+		return nil, nil
+	}
+	var points []*client.Point
+	if p.Type != "" || len(p.Fields) > 0 || p.Flatten || len(p.SubMeasurements) == 0 {
+		var fields map[string]interface{}
+		switch p.Type {
+		case "counter":
+			var ok bool
+			fields, ok = p.counterFields(tags, entry)
+			if !ok {
+				return nil, nil
+			}
+		case "gauge":
+			var ok bool
+			fields, ok = p.gaugeFields(entry)
+			if !ok {
+				return nil, nil
+			}
+		case "summary":
+			var ok bool
+			fields, ok = p.summaryFields(entry)
+			if !ok {
+				return nil, nil
+			}
+		default:
+			if p.RequireAllFields && !p.hasRequiredFields(p.Fields, entry) {
+				return nil, nil
+			}
+			var err error
+			fields, err = p.fields(entry)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		fields = fieldKeys(p.coerceFloats(p.prefixFields(fields)))
+		p.addRawField(fields, msg.payload)
+		p.logf("sending %v", fields)
+		point, err := client.NewPoint(p.measurementName(p.measurement()), pointTags, fields, timestamp)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to create a new data point")
+		}
+		points = append(points, point)
+	}
+	for _, sub := range p.SubMeasurements {
+		if p.RequireAllFields && !p.hasRequiredFields(sub.Fields, entry) {
+			continue
+		}
+		fields, err := p.entryFields(sub.Fields, entry)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		fields = fieldKeys(p.coerceFloats(p.prefixFields(fields)))
+		p.addRawField(fields, msg.payload)
+		p.logf("sending %v", fields)
+		point, err := client.NewPoint(p.measurementName(sub.Measurement), pointTags, fields, timestamp)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to create a new data point")
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// traceTag returns the value of the trace tag of the points of the
+// entry, and whether the points are sampled to hold it. Without a
+// TraceSampleRate, the points of the entries selected by SampleRate
+// hold the tag, and no points hold it if neither rate is set.
+func (p *processor) traceTag(entry map[string]interface{}) (string, bool) {
+	if p.TraceTagField == "" {
+		return "", false
+	}
+	switch {
+	case p.TraceSampleRate > 0:
+		if p.exporter.random() >= p.TraceSampleRate {
+			return "", false
+		}
+	case p.SampleRate == 0:
+		return "", false
+	}
+	value, ok := lookup(entry, p.TraceTagField)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// safePoints returns the points created from the entry, as returned by
+// points. A panic caused by a malformed entry is recovered and returned
+// as an error, so that the remaining entries are still processed.
+func (p *processor) safePoints(entry map[string]interface{}, msg message) (points []*client.Point, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logf("panic while processing entry %v: %v\n%s", entry, r, debug.Stack())
+			points, err = nil, errors.Errorf("panic while processing entry: %v", r)
+		}
+	}()
+	return p.points(entry, msg)
+}
+
+// transformPoints returns the points transformed by the exporter's
+// transform hook, without the dropped points.
+func (p *processor) transformPoints(points []*client.Point) ([]*client.Point, error) {
+	transformed := points[:0]
+	for _, point := range points {
+		point, err := p.exporter.Transform(point)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to transform a point of topic %q", p.Topic)
+		}
+		if point != nil {
+			transformed = append(transformed, point)
+		}
+	}
+	return transformed, nil
+}
+
+// dedupPoints returns the points without the points identical to a
+// previous one, i.e. with the same measurement, tags, fields and time.
+func (p *processor) dedupPoints(points []*client.Point) []*client.Point {
+	seen := make(map[string]bool, len(points))
+	deduped := points[:0]
+	for _, point := range points {
+		line := point.String()
+		if seen[line] {
+			p.logf("dropping duplicate point %s", line)
+			continue
+		}
+		seen[line] = true
+		deduped = append(deduped, point)
+	}
+	return deduped
+}
+
+// mergePoints merges the points of the same series with the same
+// timestamp into a single point holding the fields of all merged
+// points. When merged points hold the same field, the value of the last
+// point is kept. The ignoredTag, if set, does not identify the series:
+// the merged point holds its last value.
+func mergePoints(points []*client.Point, ignoredTag string) ([]*client.Point, error) {
+	type mergedPoint struct {
+		name   string
+		tags   map[string]string
+		fields map[string]interface{}
+		time   time.Time
+	}
+	var merged []*mergedPoint
+	index := make(map[string]*mergedPoint)
+	for _, point := range points {
+		fields, err := point.Fields()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		tags := point.Tags()
+		ignoredValue, ignored := tags[ignoredTag]
+		if ignored {
+			delete(tags, ignoredTag)
+		}
+		key := fmt.Sprintf("%s %d", seriesKey(point.Name(), tags), point.UnixNano())
+		m, ok := index[key]
+		if !ok {
+			m = &mergedPoint{
+				name:   point.Name(),
+				tags:   tags,
+				fields: make(map[string]interface{}, len(fields)),
+				time:   point.Time(),
+			}
+			index[key] = m
+			merged = append(merged, m)
+		}
+		if ignored {
+			m.tags[ignoredTag] = ignoredValue
+		}
+		for name, value := range fields {
+			m.fields[name] = value
+		}
+	}
+	result := make([]*client.Point, len(merged))
+	for i, m := range merged {
+		point, err := client.NewPoint(m.name, m.tags, m.fields, m.time)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to create a new data point")
+		}
+		result[i] = point
+	}
+	return result, nil
+}
+
+// prefixFields returns the fields with their names prefixed by the
+// field prefix of the topic.
+func (p *processor) prefixFields(fields map[string]interface{}) map[string]interface{} {
+	if p.FieldPrefix == "" {
+		return fields
+	}
+	prefixed := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		prefixed[p.FieldPrefix+name] = value
+	}
+	return prefixed
+}
+
+// maxRawFieldSize holds the maximum size of the raw field, which is the
+// maximum size of influxdb string fields.
+const maxRawFieldSize = 64 * 1024
+
+// addRawField adds the raw field holding the payload of the entry to
+// the fields, if the topic specifies one. Payloads exceeding the
+// maximum size of influxdb string fields are truncated. Quotes and
+// backslashes are escaped by client.NewPoint.
+func (p *processor) addRawField(fields map[string]interface{}, payload []byte) {
+	if p.RawField == "" {
+		return
+	}
+	if len(payload) > maxRawFieldSize {
+		p.logf("truncating raw field of %d bytes", len(payload))
+		payload = payload[:maxRawFieldSize]
+	}
+	fields[p.RawField] = string(payload)
+}
+
+// coerceFloats converts the integer values of the fields to floats, if
+// the topic specifies CoerceFloat.
+func (p *processor) coerceFloats(fields map[string]interface{}) map[string]interface{} {
+	if !p.CoerceFloat {
+		return fields
+	}
+	for name, value := range fields {
+		if i, ok := value.(int64); ok {
+			fields[name] = float64(i)
+		}
+	}
+	return fields
+}
+
+// timestampAt returns the timestamp of the i-th entry.
+func timestampAt(timestamps []time.Time, i int) time.Time {
+	if len(timestamps) == 1 {
+		return timestamps[0]
+	}
+	return timestamps[i]
+}
+
+// isDuplicate returns true if an entry with the same value of the dedup
+// key has already been processed.
+func (p *processor) isDuplicate(entry map[string]interface{}) bool {
+	if p.DedupKey == "" {
+		return false
+	}
+	value, ok := lookup(entry, p.DedupKey)
+	if !ok {
+		p.missingKey(p.DedupKey)
+		return false
+	}
+	key := fmt.Sprint(value)
+	if p.seen[key] {
+		p.logf("dropping duplicate entry with %v %v", p.DedupKey, key)
+		return true
+	}
+	if p.seen == nil {
+		p.seen = make(map[string]bool)
+	}
+	p.seen[key] = true
+	return false
+}
+
+// unmarshal returns the entries stored in the payload in the format of
+// the topic. Unless the topic has an array payload, the payload holds a
+// single entry.
+func (p *processor) unmarshal(payload []byte) ([]map[string]interface{}, error) {
+	if p.Format == "csv" {
+		entry, err := p.unmarshalCSV(payload)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []map[string]interface{}{entry}, nil
+	}
+	if p.ArrayPayload {
+		var entries []map[string]interface{}
+		if err := decodeJSON(payload, &entries); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return entries, nil
+	}
+	var entry map[string]interface{}
+	if err := decodeJSON(payload, &entry); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return []map[string]interface{}{entry}, nil
+}
+
+// decodeJSON decodes the JSON value held by the payload into v. Unlike
+// json.Unmarshal, numbers are decoded as json.Number so that integers
+// beyond 2^53 do not lose precision. As with json.Unmarshal, data
+// following the value is an error.
+func decodeJSON(payload []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid data after the JSON value")
+	}
+	return nil
+}
+
+// unmarshalCSV returns the entry stored in the CSV row, keyed by the
+// topic columns. Numeric values are stored as json.Number, as when
+// decoding JSON entries; NaN and infinite values, which JSON cannot
+// encode either, are kept as strings.
+func (p *processor) unmarshalCSV(payload []byte) (map[string]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(payload))
+	r.FieldsPerRecord = len(p.Columns)
+	record, err := r.Read()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	entry := make(map[string]interface{}, len(record))
+	for i, value := range record {
+		if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			entry[p.Columns[i]] = json.Number(value)
+		} else {
+			entry[p.Columns[i]] = value
+		}
+	}
+	return entry, nil
+}
+
+// ProcessError holds the error encountered while processing a single
+// entry passed to ProcessData.
+type ProcessError struct {
+	// Index holds the index of the entry in the processed data.
+	Index int
+	// Data holds the entry.
+	Data []byte
+	// Err holds the reason why the entry could not be processed,
+	// or the EntryError describing a key of the entry that could not
+	// be written.
+	Err error
+}
+
+// Error implements the error interface.
+func (e ProcessError) Error() string {
+	return fmt.Sprintf("entry %d: %s", e.Index, e.reason())
+}
+
+// reason returns the message of the reason why the entry could not be
+// processed, without the index of the entry.
+func (e ProcessError) reason() string {
+	if entryError, ok := e.Err.(*EntryError); ok {
+		return entryError.detail()
+	}
+	return fmt.Sprint(e.Err)
+}
+
+// Unwrap returns the reason why the entry could not be processed.
+func (e ProcessError) Unwrap() error {
+	return e.Err
+}
+
+// ProcessErrors is returned by ProcessData when some of the entries could
+// not be processed, in the order of the entries. An entry holding
+// several entries, e.g. a JSON array, may have several errors. The
+// remaining entries are still written, unless the OnError policy of the
+// topic is "fail", in which case the ProcessError of the first entry
+// that could not be processed is returned instead and no points are
+// written. Entries written partially, e.g. without the value of a
+// missing key, are only logged.
+type ProcessErrors []ProcessError
+
+func (e *ProcessErrors) add(index int, data []byte, err error) {
+	*e = append(*e, ProcessError{
+		Index: index,
+		Data:  data,
+		Err:   err,
+	})
+}
+
+// Error implements the error interface. The errors of each entry are
+// grouped.
+func (e ProcessErrors) Error() string {
+	var msgs []string
+	for i, processError := range e {
+		if i > 0 && processError.Index == e[i-1].Index {
+			msgs[len(msgs)-1] += ", " + processError.reason()
+			continue
+		}
+		msgs = append(msgs, processError.Error())
+	}
+	return fmt.Sprintf("failed to process %d entries: %s", len(msgs), strings.Join(msgs, "; "))
+}
+
+// entries returns the number of entries that could not be processed.
+func (e ProcessErrors) entries() int {
+	n := 0
+	for i, processError := range e {
+		if i == 0 || processError.Index != e[i-1].Index {
+			n++
+		}
+	}
+	return n
+}
+
+// Is returns true if the error of an entry matches the target, so that
+// errors.Is can be used to check the kind of failures. Is and As are
+// implemented instead of an Unwrap method, which could only return one
+// of the errors.
+func (e ProcessErrors) Is(target error) bool {
+	for _, processError := range e {
+		if stderrors.Is(processError.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of an entry that matches the target, as
+// errors.As does.
+func (e ProcessErrors) As(target interface{}) bool {
+	for _, processError := range e {
+		if stderrors.As(processError.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// counterFields returns the single field holding the difference between
+// the value of a counter entry and the previously seen value of the
+// same series. The first value seen for a series is not written and
+// false is returned. If the counter has been reset, the new value is
+// written.
+//
+// Counter entries of the same series are expected to be processed in
+// order: concurrent ProcessData calls for the same topic are safe, but
+// the resulting deltas depend on the order in which the calls are
+// processed.
+func (p *processor) counterFields(tags map[string]string, entry map[string]interface{}) (map[string]interface{}, bool) {
+	value, ok := p.value(entry)
+	if !ok {
+		return nil, false
+	}
+	key := p.counterKey(tags)
+
+	counters := p.counters
+	if counters == nil {
+		p.exporter.muCounters.Lock()
+		defer p.exporter.muCounters.Unlock()
+		if p.exporter.counters == nil {
+			p.exporter.counters = make(map[string]float64)
+		}
+		counters = p.exporter.counters
+	}
+	previous, ok := counters[key]
+	counters[key] = value
+	if !ok {
+		return nil, false
+	}
+	delta := value - previous
+	if delta < 0 {
+		// the counter was reset
+		delta = value
+	}
+	return map[string]interface{}{
+		p.fieldName(): delta,
+	}, true
+}
+
+// counterKey returns the key of the previous value of the counter with
+// the given tags. Counters of different topics or fields are kept
+// apart even when written to the same measurement.
+func (p *processor) counterKey(tags map[string]string) string {
+	return strings.Join([]string{p.Topic, p.fieldName(), seriesKey(p.measurement(), tags)}, "\xff")
+}
+
+// addToSet adds the value of the set entry to the set of its series.
+func (p *processor) addToSet(tags map[string]string, entry map[string]interface{}, timestamp time.Time) {
+	valueKey := p.ValueKey
+	if valueKey == "" {
+		valueKey = "value"
+	}
+	value, ok := lookup(entry, valueKey)
+	if !ok {
+		p.missingKey(valueKey)
+		return
+	}
+	key := seriesKey(p.measurement(), tags)
+	if p.sets == nil {
+		p.sets = make(map[string]*valueSet)
+	}
+	set, ok := p.sets[key]
+	if !ok {
+		set = &valueSet{
+			tags:   tags,
+			values: make(map[string]bool),
+		}
+		p.sets[key] = set
+	}
+	set.values[fmt.Sprint(value)] = true
+	if timestamp.After(set.timestamp) {
+		set.timestamp = timestamp
+	}
+}
+
+// setPoints returns a point for each series of a set topic holding the
+// number of distinct values seen in the processed entries. The point
+// time is the time of the latest entry.
+func (p *processor) setPoints() ([]*client.Point, error) {
+	keys := make([]string, 0, len(p.sets))
+	for key := range p.sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	points := make([]*client.Point, 0, len(keys))
+	for _, key := range keys {
+		set := p.sets[key]
+		point, err := client.NewPoint(
+			p.measurementName(p.measurement()),
+			set.tags,
+			p.coerceFloats(p.prefixFields(map[string]interface{}{
+				p.fieldName(): int64(len(set.values)),
+			})),
+			set.timestamp,
+		)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to create a new data point")
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// seriesKey returns a key identifying the series with the given
+// measurement and tags.
+func seriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{measurement}
+	for _, k := range keys {
+		parts = append(parts, k+"="+tags[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// tags returns the tags of the point created from the entry: the static
+// tags of the topic, including those extracted from the topic name, and
+// the values of the tag fields found in the entry. Null values are
+// handled as empty ones.
+// It returns false if the entry must be skipped because of an empty tag
+// value.
+func (p *processor) tags(entry map[string]interface{}) (map[string]string, bool) {
+	if len(p.TagFields) == 0 {
+		return p.staticTags, true
+	}
+	tags := make(map[string]string, len(p.staticTags)+len(p.TagFields))
+	for k, v := range p.staticTags {
+		tags[k] = v
+	}
+	for _, key := range p.TagFields {
+		value, ok := lookup(entry, key)
+		if !ok {
+			p.missingKey(key)
+			continue
+		}
+		var tag string
+		if value != nil {
+			tag = p.transform(key, fmt.Sprint(value))
+		}
+		if tag == "" {
+			switch p.EmptyTagMode {
+			case "placeholder":
+				tag = p.EmptyTagValue
+				if tag == "" {
+					tag = "unknown"
+				}
+			case "skip":
+				p.logf("skipping entry with empty tag %v", key)
+				return nil, false
+			default:
+				// client.NewPoint drops tags with empty values
+				continue
+			}
+		}
+		tags[key] = tagValue(tag)
+	}
+	return tags, true
+}
+
+// lineBreaks replaces the line breaks of tag values and field keys.
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// tagValue returns the tag value with its line breaks replaced with
+// spaces. client.NewPoint escapes the spaces, commas and equal signs of
+// tag values but not line breaks, which would split the point into
+// invalid lines of line protocol. Line breaks are kept in string fields,
+// which client.NewPoint quotes, escaping their quotes and backslashes.
+func tagValue(value string) string {
+	return lineBreaks.Replace(value)
+}
+
+// fieldKeys returns the fields with the line breaks of their keys
+// replaced with spaces, as for tag values. Field keys may be taken from
+// the entries, e.g. top-k labels, histogram boundaries and flattened
+// keys.
+func fieldKeys(fields map[string]interface{}) map[string]interface{} {
+	for key := range fields {
+		if strings.ContainsAny(key, "\r\n") {
+			result := make(map[string]interface{}, len(fields))
+			for key, value := range fields {
+				result[lineBreaks.Replace(key)] = value
+			}
+			return result
+		}
+	}
+	return fields
+}
+
+// topicTags returns the static tags of the topic and the tags extracted
+// from the topic name by the named groups of the topic regex.
+func (p *processor) topicTags() map[string]string {
+	if p.TopicRegex == "" {
+		return p.Tags
+	}
+	// the regex is checked by Validate
+	re := regexp.MustCompile(p.TopicRegex)
+	match := re.FindStringSubmatch(p.Topic)
+	if match == nil {
+		p.logf("topic %v does not match %v", p.Topic, p.TopicRegex)
+		return p.Tags
+	}
+	tags := make(map[string]string, len(p.Tags)+len(match))
+	for k, v := range p.Tags {
+		tags[k] = v
+	}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			tags[name] = match[i]
+		}
+	}
+	return tags
+}
+
+// withTag returns a copy of the tags with the given tag added.
+func withTag(tags map[string]string, key, value string) map[string]string {
+	result := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		result[k] = v
+	}
+	result[key] = tagValue(value)
+	return result
+}
+
+// transform applies the transforms configured for the entry key to the
+// string value.
+func (p *processor) transform(key, value string) string {
+	for _, op := range p.Transforms[key] {
+		switch op {
+		case "trim":
+			value = strings.TrimSpace(value)
+		case "lower":
+			value = strings.ToLower(value)
+		case "upper":
+			value = strings.ToUpper(value)
+		default:
+			p.logf("unknown transform %v", op)
+		}
+	}
+	return value
+}
+
+// fields returns the fields of the point created from the entry.
+func (p *processor) fields(entry map[string]interface{}) (map[string]interface{}, error) {
+	if p.StrictFields {
+		p.checkUndeclaredKeys(entry)
+	}
+	fields, err := p.entryFields(p.Fields, entry)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(p.ComputedFields) > 0 {
+		p.computeFields(entry, fields)
+	}
+	if p.Flatten {
+		flattened := p.flattenFields(entry)
+		// explicitly configured fields take precedence
+		for name, value := range fields {
+			flattened[name] = value
+		}
+		fields = flattened
+	}
+	return fields, nil
+}
+
+// computeFields adds the computed fields of the topic to the fields.
+// Computed fields whose expression cannot be evaluated, e.g. because of
+// a missing key or a division by zero, are not written.
+func (p *processor) computeFields(entry map[string]interface{}, fields map[string]interface{}) {
+	lookupNumber := func(key string) (float64, error) {
+		entryValue, ok := lookup(entry, key)
+		if !ok {
+			return 0, errors.Errorf("entry key not found: %v", key)
+		}
+		value, ok := floatValue(entryValue)
+		if !ok {
+			return 0, errors.Errorf("invalid number value %v for entry %v", entryValue, key)
+		}
+		return value, nil
+	}
+	for name := range p.ComputedFields {
+		expr, ok := p.expression(name)
+		if !ok {
+			continue
+		}
+		value, err := expr.eval(lookupNumber)
+		if err != nil {
+			p.logf("cannot compute field %v: %v", name, err)
+			continue
+		}
+		fields[name] = value
+	}
+}
+
+// expression returns the parsed expression of the computed field, or
+// false if it is invalid.
+func (p *processor) expression(name string) (expression, bool) {
+	if expr, ok := p.expressions[name]; ok {
+		return expr, true
+	}
+	expr, err := parseExpression(p.ComputedFields[name])
+	if err != nil {
+		// the expressions are checked by Validate
+		p.logf("%v", err)
+		return nil, false
+	}
+	if p.expressions == nil {
+		p.expressions = make(map[string]expression)
+	}
+	p.expressions[name] = expr
+	return expr, true
+}
+
+// checkUndeclaredKeys logs the keys of the entry that are not used by
+// the topic config, e.g. as field, tag or timestamp keys. Only the top
+// level keys are checked: the key of a nested object is declared if any
+// of its values is.
+func (p *processor) checkUndeclaredKeys(entry map[string]interface{}) {
+	declared := map[string]bool{
+		p.TimestampField: true,
+		p.DedupKey:       true,
+		p.TraceTagField:  true,
+	}
+	declare := func(key string) {
+		for _, key := range strings.Split(key, "|") {
+			declared[key] = true
+			if i := strings.IndexAny(key, ".["); i >= 0 {
+				declared[key[:i]] = true
+			}
+		}
+	}
+	for key := range p.Fields {
+		declare(key)
+	}
+	for _, sub := range p.SubMeasurements {
+		for key := range sub.Fields {
+			declare(key)
+		}
+	}
+	for _, key := range p.TagFields {
+		declare(key)
+	}
+	for _, condition := range p.Conditions {
+		declare(condition.Key)
+	}
+	if p.Filter != nil {
+		declare(p.Filter.Key)
+	}
+	for name := range p.ComputedFields {
+		if expr, ok := p.expression(name); ok {
+			for _, key := range expr.variables() {
+				declare(key)
+			}
+		}
+	}
+	var undeclared []string
+	for key := range entry {
+		if !declared[key] {
+			undeclared = append(undeclared, key)
+		}
+	}
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		p.logf("undeclared entry keys: %v", strings.Join(undeclared, ", "))
+		p.stats.UndeclaredKeys += int64(len(undeclared))
+	}
+}
+
+// defaultMaxDepth holds the default depth of the nested objects
+// flattened into fields.
+const defaultMaxDepth = 10
+
+// flattenFields returns the fields holding all the values of the entry,
+// including those of nested objects and arrays, named by joining their
+// keys and indexes with the field separator. Numbers are written as
+// floats, strings and booleans as is. Tag fields, the trace tag field
+// and the timestamp field are not written.
+func (p *processor) flattenFields(entry map[string]interface{}) map[string]interface{} {
+	separator := p.FieldSeparator
+	if separator == "" {
+		separator = "_"
+	}
+	maxDepth := p.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = defaultMaxDepth
+	}
+	fields := make(map[string]interface{})
+	var flatten func(name string, value interface{}, depth int)
+	flatten = func(name string, value interface{}, depth int) {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if depth >= maxDepth {
+				p.logf("not flattening %v beyond depth %d", name, maxDepth)
+				return
+			}
+			for k, v := range value {
+				if name != "" {
+					k = name + separator + k
+				}
+				flatten(k, v, depth+1)
+			}
+		case []interface{}:
+			if depth >= maxDepth {
+				p.logf("not flattening %v beyond depth %d", name, maxDepth)
+				return
+			}
+			for i, v := range value {
+				flatten(name+separator+strconv.Itoa(i), v, depth+1)
+			}
+		case json.Number:
+			f, ok := floatValue(value)
+			if !ok {
+				p.invalidValue("number", value, name)
+				return
+			}
+			fields[name] = f
+		case float64, string, bool:
+			fields[name] = value
+		}
+	}
+	for k, v := range entry {
+		if p.isTagField(k) || k == p.TimestampField || k == p.TraceTagField {
+			continue
+		}
+		flatten(k, v, 1)
+	}
+	return fields
+}
+
+// lookup returns the value of the entry key. Dotted keys refer to values
+// of nested objects, e.g. "cpu.user" refers to the "user" key of the
+// object stored under the "cpu" key, and indexes refer to elements of
+// arrays, e.g. "values[1]" refers to the second element of the array
+// stored under the "values" key.
+func lookup(entry map[string]interface{}, key string) (interface{}, bool) {
+	if value, ok := entry[key]; ok {
+		return value, true
+	}
+	var value interface{} = entry
+	for _, part := range strings.Split(key, ".") {
+		name, indexes, ok := parseIndexes(part)
+		if !ok {
+			return nil, false
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[name]
+		if !ok {
+			return nil, false
+		}
+		for _, index := range indexes {
+			array, ok := value.([]interface{})
+			if !ok || index >= len(array) {
+				return nil, false
+			}
+			value = array[index]
+		}
+	}
+	return value, true
+}
+
+// lookupFallback is like lookup, but the key may list fallback keys
+// separated by "|", e.g. "latency_ms|latencyMs", which are tried in
+// order. The value of the first key found is returned.
+func lookupFallback(entry map[string]interface{}, key string) (interface{}, bool) {
+	for _, key := range strings.Split(key, "|") {
+		if value, ok := lookup(entry, key); ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// parseIndexes splits a part of a dotted key into the object key and the
+// array indexes following it, e.g. "values[1][2]" is split into "values"
+// and [1, 2].
+func parseIndexes(part string) (string, []int, bool) {
+	i := strings.Index(part, "[")
+	if i < 0 {
+		return part, nil, true
+	}
+	name, rest := part[:i], part[i:]
+	var indexes []int
+	for rest != "" {
+		end := strings.Index(rest, "]")
+		if rest[0] != '[' || end < 0 {
+			return "", nil, false
+		}
+		index, err := strconv.Atoi(rest[1:end])
+		if err != nil || index < 0 {
+			return "", nil, false
+		}
+		indexes = append(indexes, index)
+		rest = rest[end+1:]
+	}
+	return name, indexes, true
+}
+
+// histFields adds the buckets of the histogram stored under the entry
+// key to the fields. Bucket counts are written as float values, so
+// fractional counts of weighted histograms are preserved.
+//
+// Buckets are processed in numeric order of their boundaries. Bucket
+// boundaries formatted to the same field name collide and are handled
+// as specified by the CollisionMode of the topic config, so with the
+// "last" mode the value of the highest boundary is kept.
+//
+// The line protocol written by the influxdb client always lists fields
+// sorted by name, so the output does not depend on map iteration order.
+func (p *processor) histFields(key string, entryValue interface{}, fields map[string]interface{}) error {
+	buckets, ok := p.buckets(entryValue)
+	if !ok {
+		p.invalidValue("histogram", entryValue, key)
+		return nil
+	}
+	if p.BucketStep > 0 {
+		buckets = p.fillBuckets(buckets)
+	}
+	// origins maps field names to the bucket boundaries they were
+	// formatted from.
+	origins := make(map[string]string, len(buckets))
+	for _, k := range sortedBoundaries(buckets) {
+		v := buckets[k]
+		value, ok := floatValue(v)
+		if !ok {
+			p.invalidValue("number", v, key+"."+k)
+			continue
+		}
+		if p.belowMinValue(value) {
+			p.logf("skipping %v value %v below the min value", key+"."+k, value)
+			continue
+		}
+		name := p.bucketKey(k)
+		if origin, ok := origins[name]; ok {
+			p.logf("histogram buckets %v and %v collide as field %v", origin, k, name)
+			switch p.CollisionMode {
+			case "sum":
+				value += fields[name].(float64)
+			case "error":
+				return errors.Errorf("histogram buckets %v and %v collide as field %v", origin, k, name)
+			}
+		}
+		origins[name] = k
+		fields[name] = value
+	}
+	return nil
+}
+
+// fillBuckets returns a copy of the histogram buckets holding a zero
+// count for each boundary between BucketMin and BucketMax, every
+// BucketStep, missing from the buckets. As Validate would, a range
+// holding too many buckets is rejected: the buckets are returned
+// unfilled.
+func (p *processor) fillBuckets(buckets map[string]interface{}) map[string]interface{} {
+	n := p.filledBuckets()
+	if n > maxFilledBuckets {
+		p.logf("too many buckets from %d to %d every %d", p.BucketMin, p.BucketMax, p.BucketStep)
+		return buckets
+	}
+	present := make(map[float64]bool, len(buckets))
+	filled := make(map[string]interface{}, len(buckets)+int(n))
+	for k, v := range buckets {
+		if f, err := strconv.ParseFloat(k, 64); err == nil {
+			present[f] = true
+		}
+		filled[k] = v
+	}
+	// the boundaries are computed from BucketMin, as adding BucketStep
+	// to the last one may overflow.
+	for i := 0; i < int(n); i++ {
+		boundary := p.BucketMin + i*p.BucketStep
+		if !present[float64(boundary)] {
+			filled[strconv.Itoa(boundary)] = float64(0)
+		}
+	}
+	return filled
+}
+
+// belowMinValue returns true if the "hist" or "top-k" value is below the
+// min value of the topic and must not be written.
+func (p *processor) belowMinValue(value float64) bool {
+	return p.MinValue != 0 && value < p.MinValue
+}
+
+// sortedBoundaries returns the bucket boundaries of the histogram in
+// numeric order. Non-numeric boundaries are sorted after the numeric
+// ones, by name.
+func sortedBoundaries(buckets map[string]interface{}) []string {
+	boundaries := make([]string, 0, len(buckets))
+	for k := range buckets {
+		boundaries = append(boundaries, k)
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		a, errA := strconv.ParseFloat(boundaries[i], 64)
+		b, errB := strconv.ParseFloat(boundaries[j], 64)
+		switch {
+		case errA == nil && errB == nil && a != b:
+			return a < b
+		case errA == nil && errB != nil:
+			return true
+		case errA != nil && errB == nil:
+			return false
+		}
+		return boundaries[i] < boundaries[j]
+	})
+	return boundaries
+}
+
+// buckets returns the counts of the histogram buckets stored in the
+// entry value keyed by bucket boundary.
+func (p *processor) buckets(entryValue interface{}) (map[string]interface{}, bool) {
+	if !p.BucketArray {
+		buckets, ok := entryValue.(map[string]interface{})
+		return buckets, ok
+	}
+	items, ok := entryValue.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	bucketKey := p.BucketKey
+	if bucketKey == "" {
+		bucketKey = "le"
+	}
+	countKey := p.CountKey
+	if countKey == "" {
+		countKey = "count"
+	}
+	buckets := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			p.logf("invalid histogram bucket %v", item)
+			continue
+		}
+		boundary, ok := object[bucketKey]
+		if !ok {
+			p.missingKey(bucketKey)
+			continue
+		}
+		count, ok := object[countKey]
+		if !ok {
+			p.missingKey(countKey)
+			continue
+		}
+		buckets[fmt.Sprint(boundary)] = count
+	}
+	return buckets, true
+}
+
+// topKValues returns the values of the "top-k" field stored in the
+// entry value keyed by label. The entry value either holds an object
+// keyed by label or an array of objects holding a label and a count.
+func (p *processor) topKValues(entryValue interface{}) (map[string]interface{}, bool) {
+	switch entryValue := entryValue.(type) {
+	case map[string]interface{}:
+		return entryValue, true
+	case []interface{}:
+		labelKey := p.LabelKey
+		if labelKey == "" {
+			labelKey = "name"
+		}
+		countKey := p.CountKey
+		if countKey == "" {
+			countKey = "count"
+		}
+		values := make(map[string]interface{}, len(entryValue))
+		for _, item := range entryValue {
+			object, ok := item.(map[string]interface{})
+			if !ok {
+				p.logf("invalid top-k item %v", item)
+				continue
+			}
+			label, ok := object[labelKey]
+			if !ok {
+				p.missingKey(labelKey)
+				continue
+			}
+			count, ok := object[countKey]
+			if !ok {
+				p.missingKey(countKey)
+				continue
+			}
+			values[fmt.Sprint(label)] = count
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+// topKFields adds the K highest values of the "top-k" field stored under
+// the entry key to the fields. Ties are broken by key.
+func (p *processor) topKFields(key string, entryValue interface{}, fields map[string]interface{}) {
+	values, ok := p.topKValues(entryValue)
+	if !ok {
+		p.invalidValue("top-k", entryValue, key)
+		return
+	}
+	type item struct {
+		key   string
+		value float64
+	}
+	items := make([]item, 0, len(values))
+	for k, v := range values {
+		value, ok := floatValue(v)
+		if !ok {
+			p.invalidValue("number", v, key+"."+k)
+			continue
+		}
+		if p.belowMinValue(value) {
+			p.logf("skipping %v value %v below the min value", key+"."+k, value)
+			continue
+		}
+		items = append(items, item{key: k, value: value})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].value != items[j].value {
+			return items[i].value > items[j].value
+		}
+		return items[i].key < items[j].key
+	})
+	if p.K > 0 && len(items) > p.K {
+		if p.OtherField != "" {
+			var other float64
+			for _, item := range items[p.K:] {
+				other += item.value
+			}
+			fields[p.OtherField] = other
+		}
+		items = items[:p.K]
+	}
+	for _, item := range items {
+		fields[item.key] = item.value
+	}
+}
+
+// gaugeFields returns the single field holding the value of a gauge
+// entry. False is returned if the entry holds no valid value.
+func (p *processor) gaugeFields(entry map[string]interface{}) (map[string]interface{}, bool) {
+	value, ok := p.value(entry)
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{
+		p.fieldName(): value,
+	}, true
+}
+
+// summaryFields returns the fields holding the min, max, mean, count
+// and configured percentiles of the samples of a summary entry. False
+// is returned if the entry holds no valid samples.
+func (p *processor) summaryFields(entry map[string]interface{}) (map[string]interface{}, bool) {
+	valueKey := p.ValueKey
+	if valueKey == "" {
+		valueKey = "value"
+	}
+	entryValue, ok := lookup(entry, valueKey)
+	if !ok {
+		p.missingKey(valueKey)
+		return nil, false
+	}
+	items, ok := entryValue.([]interface{})
+	if !ok {
+		p.invalidValue("summary", entryValue, valueKey)
+		return nil, false
+	}
+	samples := make([]float64, 0, len(items))
+	for _, item := range items {
+		sample, ok := floatValue(item)
+		if !ok {
+			p.invalidValue("number", item, valueKey)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	if len(samples) == 0 {
+		p.logf("no samples for entry %v", valueKey)
+		return nil, false
+	}
+	min, max, sum := samples[0], samples[0], 0.0
+	for _, sample := range samples {
+		if sample < min {
+			min = sample
+		}
+		if sample > max {
+			max = sample
+		}
+		sum += sample
+	}
+	fields := map[string]interface{}{
+		"min":   min,
+		"max":   max,
+		"mean":  sum / float64(len(samples)),
+		"count": int64(len(samples)),
+	}
+	if len(p.Percentiles) > 0 {
+		sort.Float64s(samples)
+		for _, percentile := range p.Percentiles {
+			name := "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+			fields[name] = percentileValue(samples, percentile)
+		}
+	}
+	return fields, true
+}
+
+// percentileValue returns the percentile of the sorted samples, linearly
+// interpolated between the closest samples.
+func percentileValue(samples []float64, percentile float64) float64 {
+	rank := percentile / 100 * float64(len(samples)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return samples[lower]
+	}
+	return samples[lower] + (rank-float64(lower))*(samples[upper]-samples[lower])
+}
+
+// value returns the numeric value of a gauge or counter entry.
+func (p *processor) value(entry map[string]interface{}) (float64, bool) {
+	valueKey := p.ValueKey
+	if valueKey == "" {
+		valueKey = "value"
+	}
+	entryValue, ok := lookup(entry, valueKey)
+	if !ok {
+		p.missingKey(valueKey)
+		return 0, false
+	}
+	value, ok := floatValue(entryValue)
+	if !ok {
+		p.invalidValue("number", entryValue, valueKey)
+		return 0, false
+	}
+	return value, true
+}
+
+// hasRequiredFields returns true if the entry holds the keys of all the
+// fields that are not optional, not written as tags, and have no default
+// value or condition preventing them from being written. Otherwise the
+// missing key is logged.
+func (p *processor) hasRequiredFields(fields map[string]string, entry map[string]interface{}) bool {
+	for key, entryType := range fields {
+		if _, optional := parseFieldType(entryType); optional || p.isTagField(key) {
+			continue
+		}
+		if condition, ok := p.Conditions[key]; ok && !condition.holds(entry) {
+			continue
+		}
+		if _, ok := p.Defaults[key]; ok {
+			continue
+		}
+		if value, ok := lookupFallback(entry, key); !ok || value == nil {
+			p.logf("skipping entry without required field %v", key)
+			p.missingKey(key)
+			return false
+		}
+	}
+	return true
+}
+
+// entryFields returns the fields of the point created from the entry, as
+// specified by the fields, which map entry keys to field types.
+func (p *processor) entryFields(fields map[string]string, entry map[string]interface{}) (map[string]interface{}, error) {
+	p.logf("looking for fields: %v", fields)
+	entryC := make(map[string]interface{})
+	for key, entryType := range fields {
+		if p.isTagField(key) {
+			continue
+		}
+		if condition, ok := p.Conditions[key]; ok && !condition.holds(entry) {
+			continue
+		}
+		entryType, optional := parseFieldType(entryType)
+		entryValue, ok := lookupFallback(entry, key)
+		if !ok || entryValue == nil {
+			// null values are treated as absent fields
+			defaultValue, hasDefault := p.Defaults[key]
+			switch {
+			case hasDefault:
+				entryValue = parseDefault(entryType, defaultValue)
+			case ok:
+				p.logf("skipping null value of %v", key)
+				continue
+			case optional:
+				p.logf("skipping missing optional key %v", key)
+				continue
+			default:
+				p.missingKey(key)
+				continue
+			}
+		}
+		name := p.fieldKey(key)
+		if mapped, ok := p.ValueMaps[key][fmt.Sprint(entryValue)]; ok {
+			entryC[name] = mapped
+			continue
+		}
+		switch entryType {
+		case "number", "float":
+			value, ok := floatValue(entryValue)
+			if !ok {
+				p.invalidValue("number", entryValue, key)
+				continue
+			}
+			if scale := p.Scale[key]; scale != 0 {
+				value *= scale
+			}
+			if clamp, ok := p.Clamp[key]; ok {
+				var clamped bool
+				if value, clamped = clamp.clamp(value); clamped && clamp.Log {
+					p.logf("clamping value %v of field %v to %v", entryValue, key, value)
+				}
+			}
+			entryC[name] = value
+		case "integer":
+			value, ok := integerValue(entryValue)
+			if !ok {
+				p.invalidValue("integer", entryValue, key)
+				continue
+			}
+			entryC[name] = value
+		case "string":
+			value, ok := stringValue(entryValue)
+			if !ok {
+				p.invalidValue("string", entryValue, key)
+				continue
+			}
+			entryC[name] = p.transform(key, value)
+		case "boolean":
+			value, ok := booleanValue(entryValue)
+			if !ok {
+				p.invalidValue("boolean", entryValue, key)
+				continue
+			}
+			entryC[name] = value
+		case "hist":
+			if err := p.histFields(key, entryValue, entryC); err != nil {
+				return nil, errors.Trace(err)
+			}
+		case "top-k":
+			p.topKFields(key, entryValue, entryC)
+		default:
+			p.logf("unknown entry type %v", entryType)
+		}
+	}
+	return entryC, nil
+}
+
+// timestamp returns the time of the point stored in the timestamp field
+// of the entry. If the timestamp field is not specified, not present in
+// the entry or cannot be parsed, the default time is returned.
+func (p *processor) timestamp(entry map[string]interface{}, defaultTime time.Time) time.Time {
+	if p.TimestampField == "" {
+		return defaultTime
+	}
+	value, ok := lookup(entry, p.TimestampField)
+	if !ok {
+		p.missingKey(p.TimestampField)
+		return defaultTime
+	}
+	t, err := parseTimestamp(value, p.TimestampFormat)
+	if err != nil {
+		p.logf("failed to parse timestamp %v: %v", value, err)
+		return defaultTime
+	}
+	return t
+}
+
+// parseTimestamp parses the timestamp value in the given format.
+func parseTimestamp(value interface{}, format string) (time.Time, error) {
+	switch format {
+	case "unix", "unixms":
+		var n json.Number
+		switch v := value.(type) {
+		case json.Number:
+			n = v
+		case string:
+			n = json.Number(v)
+		default:
+			return time.Time{}, errors.Errorf("invalid unix timestamp type %T", value)
+		}
+		unit := time.Second
+		if format == "unixms" {
+			unit = time.Millisecond
+		}
+		nanos, err := unixNanos(string(n), unit)
+		if err != nil {
+			return time.Time{}, errors.Trace(err)
+		}
+		return time.Unix(0, nanos), nil
+	default:
+		s, ok := value.(string)
+		if !ok {
+			return time.Time{}, errors.Errorf("invalid timestamp type %T", value)
+		}
+		if format == "" {
+			format = time.RFC3339
+		}
+		t, err := time.Parse(format, s)
+		if err != nil {
+			return time.Time{}, errors.Trace(err)
+		}
+		return t, nil
+	}
+}
+
+// unixNanos returns the nanoseconds of the decimal number of units, e.g.
+// "1700000000.123" seconds. The integer and fractional parts are scaled
+// separately, as float64 values do not hold the nanoseconds of current
+// times exactly. Timestamps whose nanoseconds overflow an int64 are
+// rejected.
+func unixNanos(s string, unit time.Duration) (int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.ContainsAny(s, "eE") {
+		// exponent notation, e.g. 1.7e9, holds no sub-unit digits
+		// worth preserving.
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if math.IsNaN(f) || f >= float64(math.MaxInt64/int64(unit)) || f <= float64(math.MinInt64/int64(unit)) {
+			return 0, errors.Errorf("unix timestamp %q out of range", s)
+		}
+		return int64(f * float64(unit)), nil
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	negative := strings.HasPrefix(intPart, "-")
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil && !(intPart == "-" || intPart == "") {
+		return 0, errors.Trace(err)
+	}
+	if units > math.MaxInt64/int64(unit) || units < math.MinInt64/int64(unit) {
+		return 0, errors.Errorf("unix timestamp %q out of range", s)
+	}
+	nanos := units * int64(unit)
+	if fracPart == "" {
+		return nanos, nil
+	}
+	// the fractional digits beyond the nanosecond are truncated.
+	digits := len(strconv.FormatInt(int64(unit), 10)) - 1
+	if len(fracPart) > digits {
+		fracPart = fracPart[:digits]
+	}
+	fracPart += strings.Repeat("0", digits-len(fracPart))
+	frac, err := strconv.ParseUint(fracPart, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid unix timestamp %q", s)
+	}
+	if negative {
+		if nanos < math.MinInt64+int64(frac) {
+			return 0, errors.Errorf("unix timestamp %q out of range", s)
+		}
+		return nanos - int64(frac), nil
+	}
+	if nanos > math.MaxInt64-int64(frac) {
+		return 0, errors.Errorf("unix timestamp %q out of range", s)
+	}
+	return nanos + int64(frac), nil
+}
+
+// parseDefault returns the entry value represented by the default value
+// of a field of the given type.
+func parseDefault(entryType, defaultValue string) interface{} {
+	switch entryType {
+	case "number", "float", "integer":
+		return json.Number(defaultValue)
+	}
+	return defaultValue
+}
+
+// stringValue converts the entry value to a string. Numeric values of
+// CSV entries are converted back to their string representation.
+func stringValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// booleanValue converts the entry value to a boolean. Apart from JSON
+// booleans the strings "true" and "false" and the numbers 0 and 1 are
+// accepted.
+func booleanValue(v interface{}) (bool, bool) {
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case string:
+		switch v {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	case json.Number:
+		switch v.String() {
+		case "1":
+			return true, true
+		case "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// floatValue converts the entry value to a float64. Numbers encoded as
+// strings, e.g. "42", are accepted. NaN and infinite values, which
+// influxdb does not support, are not.
+func floatValue(v interface{}) (float64, bool) {
+	var f float64
+	switch v := v.(type) {
+	case float64:
+		f = v
+	case json.Number:
+		var err error
+		f, err = v.Float64()
+		if err != nil {
+			return 0, false
+		}
+	case string:
+		var err error
+		f, err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// integerValue converts the entry value to an int64. Values are parsed
+// from their JSON representation so no precision is lost for values
+// that cannot be represented as a float64, e.g. 64-bit identifiers.
+// Integers encoded as strings, as producers often do for such
+// identifiers, are accepted.
+func integerValue(v interface{}) (int64, bool) {
+	var s string
+	switch v := v.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = strings.TrimSpace(v)
+	default:
+		return 0, false
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return i, true
+}
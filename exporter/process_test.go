@@ -0,0 +1,1627 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/clock/testclock"
+	jujuerrors "github.com/juju/errors"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+	"github.com/cloud-green/metamorphosis/exporter/exportertest"
+)
+
+func TestMaxPointsPerCall(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:            "cpu",
+		Fields:           map[string]string{"a": "number"},
+		MaxPointsPerCall: 2,
+	}
+	w, err := processData(t, newExporter(t), config,
+		`{"a": 1}`,
+		`{"a": 2}`,
+		`{"a": 3}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.BatchPoints()); n != 2 {
+		t.Errorf("got %d batches, expected 2", n)
+	}
+	assertLines(t, lines(w.Points()),
+		"cpu a=1 1000000000",
+		"cpu a=2 1000000000",
+		"cpu a=3 1000000000",
+	)
+}
+
+func TestMaxPointsPerCallArrayPayload(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:            "cpu",
+		Fields:           map[string]string{"a": "number"},
+		ArrayPayload:     true,
+		MaxPointsPerCall: 2,
+	}
+	w, err := processData(t, newExporter(t), config,
+		`[{"a": 1}, {"a": 2}, {"a": 3}, {"a": 4}, {"a": 5}]`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entries of a single message are split across batches.
+	var sizes []int
+	for _, bp := range w.BatchPoints() {
+		sizes = append(sizes, len(bp.Points()))
+	}
+	if !reflect.DeepEqual(sizes, []int{2, 2, 1}) {
+		t.Errorf("got batches of %v points, expected [2 2 1]", sizes)
+	}
+	assertLines(t, lines(w.Points()),
+		"cpu a=1 1000000000",
+		"cpu a=2 1000000000",
+		"cpu a=3 1000000000",
+		"cpu a=4 1000000000",
+		"cpu a=5 1000000000",
+	)
+}
+
+func TestMaxPointsPerCallFail(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:            "cpu",
+		Fields:           map[string]string{"a": "number"},
+		MaxPointsPerCall: 1,
+		OnError:          "fail",
+	}
+	w, err := processData(t, newExporter(t), config,
+		`{"a": 1}`,
+		`{"a": 2}`,
+		`{`,
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if points := w.Points(); len(points) != 0 {
+		t.Errorf("got %q written, expected no points", lines(points))
+	}
+}
+
+func TestGaugeRawFieldMissingValue(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:    "cpu",
+		Type:     "gauge",
+		RawField: "raw",
+	}
+	logger := &logRecorder{}
+	w, err := processData(t, &exporter.Exporter{Logger: logger}, config,
+		`{"value": 1}`,
+		`{"other": 2}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.entryError(exporter.ErrMissingKey) == nil {
+		t.Errorf("got %q, expected a missing key error", logger.msgs)
+	}
+	assertLines(t, lines(w.Points()), `cpu raw="{\"value\": 1}",value=1 1000000000`)
+}
+
+func TestStrictFields(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"a": "number"},
+		TagFields: []string{"host"},
+	}
+	entry := `{"a": 1, "host": "x", "b": 2, "c": 3}`
+	logger := &logRecorder{}
+	got, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu,host=x a=1 1000000000")
+	if logger.contains("undeclared") {
+		t.Errorf("undeclared keys logged without strict fields: %q", logger.msgs)
+	}
+
+	config.StrictFields = true
+	logger = &logRecorder{}
+	got, err = buildPoints(t, &exporter.Exporter{Logger: logger}, config, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the undeclared keys are not written.
+	assertLines(t, got, "cpu,host=x a=1 1000000000")
+	if !logger.contains("undeclared entry keys: b, c") {
+		t.Errorf("the undeclared keys are not logged: %q", logger.msgs)
+	}
+}
+
+func TestStrictFieldsComputedFields(t *testing.T) {
+	e := newExporter(t)
+	config := exporter.TopicConfig{
+		Topic:        "mem",
+		Fields:       map[string]string{"total": "number"},
+		StrictFields: true,
+		ComputedFields: map[string]string{
+			"ratio": "(used + cache.size) / total",
+		},
+	}
+	w, err := processData(t, e, config, `{"used": 1, "cache": {"size": 1}, "total": 4, "other": 0}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "mem ratio=0.5,total=4 1000000000")
+	// only the "other" key is not declared.
+	if n := e.Stats()["mem"].UndeclaredKeys; n != 1 {
+		t.Errorf("got %d undeclared keys, expected 1", n)
+	}
+}
+
+func TestBuildPointsState(t *testing.T) {
+	e := newExporter(t)
+	config := exporter.TopicConfig{
+		Topic: "requests",
+		Type:  "counter",
+	}
+	got, err := buildPoints(t, e, config, `{"value": 1}`, `{"value": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "requests value=2 1000000000")
+	// building the points again does not see the previous counter
+	// values.
+	got, err = buildPoints(t, e, config, `{"value": 5}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got)
+	if stats := e.Stats(); len(stats) != 0 {
+		t.Errorf("got stats %v, expected none", stats)
+	}
+	// nor are the counter values seen by BuildPoints used when
+	// writing the points.
+	w, err := processData(t, e, config, `{"value": 5}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()))
+}
+
+func TestHeartbeatStats(t *testing.T) {
+	e := newExporter(t)
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"a": "number"},
+		Heartbeat: "heartbeat",
+	}
+	w, err := processData(t, e, config, `{"a": 1}`, `{"a": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Points()); n != 3 {
+		t.Fatalf("got %d points, expected 3", n)
+	}
+	// the heartbeat point is written but not counted.
+	if n := e.Stats()["cpu"].PointsWritten; n != 2 {
+		t.Errorf("got %d points written, expected 2", n)
+	}
+	heartbeats := w.Find(exportertest.PointMatcher{
+		Measurement: "heartbeat",
+		Tags:        map[string]string{"topic": "cpu"},
+		Fields: map[string]interface{}{
+			"entries": int64(2),
+			"points":  int64(2),
+			"errors":  int64(0),
+		},
+	})
+	if len(heartbeats) != 1 {
+		t.Errorf("got %d matching heartbeat points, expected 1", len(heartbeats))
+	}
+}
+
+func TestHeartbeatWriteError(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"a": "number"},
+		Heartbeat: "heartbeat",
+	}
+	// the heartbeat point is written although the points of the
+	// entries could not be written.
+	w := &fakeWriter{errs: []error{errors.New("connection refused")}}
+	err := newExporter(t).ProcessData(context.Background(), config, w, entries(`{"a": 1}`), []time.Time{epoch})
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("got %v, expected the write error", err)
+	}
+	heartbeats := w.Find(exportertest.PointMatcher{
+		Measurement: "heartbeat",
+		Fields: map[string]interface{}{
+			"entries": int64(1),
+			"points":  int64(0),
+			"errors":  int64(1),
+		},
+	})
+	if len(heartbeats) != 1 {
+		t.Errorf("got %d matching heartbeat points, expected 1", len(heartbeats))
+	}
+}
+
+func TestNumberFieldTypes(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "ids",
+		Fields: map[string]string{
+			"id":    "integer",
+			"ratio": "float",
+			"n":     "number",
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"id": 9007199254740993, "ratio": 2, "n": 1.5}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// integers beyond 2^53 are written exactly.
+	assertLines(t, got, "ids id=9007199254740993i,n=1.5,ratio=2 1000000000")
+
+	logger := &logRecorder{}
+	buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"id": 1.5}`)
+	if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+		t.Errorf("got %q, expected a field type mismatch error", logger.msgs)
+	}
+
+	// data following the entry is rejected.
+	got, err = buildPoints(t, newExporter(t), config, `{"id": 1} garbage`, `{"id": 2} {"id": 3}`, "{\"id\": 4, \"ratio\": 1, \"n\": 1}\n")
+	if _, ok := err.(exporter.ProcessErrors); !ok {
+		t.Errorf("got %v, expected ProcessErrors", err)
+	} else if n := len(err.(exporter.ProcessErrors)); n != 2 {
+		t.Errorf("got %d errors, expected 2: %v", n, err)
+	}
+	assertLines(t, got, "ids id=4i,n=1,ratio=1 1000000000")
+}
+
+func TestStringNumbers(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"a": "42"}`, `{"a": " 1.5 "}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu a=42 1000000000", "cpu a=1.5 1000000000")
+
+	logger := &logRecorder{}
+	buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"a": "many"}`)
+	if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+		t.Errorf("got %q, expected a field type mismatch error", logger.msgs)
+	}
+
+	// NaN and infinite values are invalid values of their field only.
+	config.Fields["b"] = "number"
+	for _, value := range []string{"NaN", "Inf", "+Inf", "-Infinity"} {
+		logger := &logRecorder{}
+		got, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"a": "`+value+`", "b": 1}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+			t.Errorf("%s: got %q, expected a field type mismatch error", value, logger.msgs)
+		}
+		assertLines(t, got, "cpu b=1 1000000000")
+	}
+}
+
+func TestIntegerPrecision(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "ids",
+		Fields: map[string]string{"id": "integer"},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"id": 9223372036854775807}`, `{"id": -9223372036854775808}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got,
+		"ids id=9223372036854775807i 1000000000",
+		"ids id=-9223372036854775808i 1000000000",
+	)
+
+	logger := &logRecorder{}
+	buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"id": 9223372036854775808}`)
+	if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+		t.Errorf("got %q, expected a field type mismatch error", logger.msgs)
+	}
+}
+
+func TestBooleanField(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "service",
+		Fields: map[string]string{"healthy": "boolean", "n": "number?"},
+	}
+	got, err := buildPoints(t, newExporter(t), config,
+		`{"healthy": true}`,
+		`{"healthy": "false"}`,
+		`{"healthy": 1}`,
+		`{"healthy": 0}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got,
+		"service healthy=true 1000000000",
+		"service healthy=false 1000000000",
+		"service healthy=true 1000000000",
+		"service healthy=false 1000000000",
+	)
+
+	// invalid values skip the field, not the point.
+	logger := &logRecorder{}
+	got, err = buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"healthy": "maybe", "n": 1}`, `{"healthy": 2, "n": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+		t.Errorf("got %q, expected a field type mismatch error", logger.msgs)
+	}
+	assertLines(t, got, "service n=1 1000000000", "service n=2 1000000000")
+}
+
+func TestTagFields(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"a": "number", "host": "string"},
+		TagFields: []string{"host", "core"},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"a": 1, "host": "x", "core": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys listed as both tags and fields are only written as tags,
+	// and non-string values are stringified.
+	assertLines(t, got, "cpu,core=3,host=x a=1 1000000000")
+
+	// points are written without the missing tags, which are only
+	// logged.
+	logger := &logRecorder{}
+	e := &exporter.Exporter{Logger: logger}
+	got, err = buildPoints(t, e, config, `{"a": 2, "host": "x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu,host=x a=2 1000000000")
+	if !logger.contains(`topic "cpu" entry 0: entry key not found: core`) {
+		t.Errorf("missing tag not logged: %q", logger.msgs)
+	}
+
+	// dotted keys refer to nested values.
+	config.Fields = map[string]string{"a": "number"}
+	config.TagFields = []string{"meta.host"}
+	got, err = buildPoints(t, newExporter(t), config, `{"a": 3, "meta": {"host": "y"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu,meta.host=y a=3 1000000000")
+}
+
+func TestMeasurement(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:       "test-topic",
+		Measurement: "cpu",
+		Fields:      map[string]string{"a": "number"},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu a=1 1000000000")
+}
+
+func TestMeasurementPrefixSuffix(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "test-topic",
+		Fields: map[string]string{"a": "number"},
+	}
+	e := newExporter(t)
+	e.MeasurementSuffix = "_prod"
+	got, err := buildPoints(t, e, config, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic_prod a=1 1000000000")
+
+	// the topic measurement and sub-measurements are also renamed.
+	config.Measurement = "cpu"
+	config.SubMeasurements = []exporter.MeasurementConfig{{
+		Measurement: "mem",
+		Fields:      map[string]string{"used": "number"},
+	}}
+	e.MeasurementPrefix = "eu_"
+	got, err = buildPoints(t, e, config, `{"a": 1, "used": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "eu_cpu_prod a=1 1000000000", "eu_mem_prod used=2 1000000000")
+}
+
+func TestStaticTags(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "test-topic",
+		Tags: map[string]string{
+			"region": "eu",
+			"env":    "prod",
+		},
+		Fields: map[string]string{
+			"a": "number?",
+			"h": "hist?",
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"a": 1}`, `{"h": {"10": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the static tags are written regardless of the field types.
+	assertLines(t, got,
+		"test-topic,env=prod,region=eu a=1 1000000000",
+		"test-topic,env=prod,region=eu 10=2 1000000000",
+	)
+}
+
+func TestSingleBatch(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	w, err := processData(t, newExporter(t), config, `{"a": 1}`, `{"a": 2}`, `{"a": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := w.BatchPoints()
+	if len(batches) != 1 {
+		t.Fatalf("got %d writes, expected 1", len(batches))
+	}
+	assertLines(t, lines(batches[0].Points()),
+		"cpu a=1 1000000000",
+		"cpu a=2 1000000000",
+		"cpu a=3 1000000000",
+	)
+}
+
+func TestGauge(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "test-topic",
+		Type:  "gauge",
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"value": 3.14}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic value=3.14 1000000000")
+
+	config.ValueKey = "temp"
+	config.FieldName = "celsius"
+	got, err = buildPoints(t, newExporter(t), config, `{"temp": 21}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic celsius=21 1000000000")
+
+	config.ValueKey = "sensor.temp"
+	got, err = buildPoints(t, newExporter(t), config, `{"sensor": {"temp": 22}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "test-topic celsius=22 1000000000")
+}
+
+func TestCounter(t *testing.T) {
+	e := newExporter(t)
+	config := exporter.TopicConfig{
+		Topic:     "requests",
+		Type:      "counter",
+		TagFields: []string{"host"},
+	}
+	// the first value of each series is only recorded.
+	w, err := processData(t, e, config, `{"host": "a", "value": 10}`, `{"host": "b", "value": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()))
+
+	w, err = processData(t, e, config, `{"host": "a", "value": 15}`, `{"host": "b", "value": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the counter of host b was reset.
+	assertLines(t, lines(w.Points()),
+		"requests,host=a value=5 1000000000",
+		"requests,host=b value=1 1000000000",
+	)
+}
+
+func TestCounterTopics(t *testing.T) {
+	e := newExporter(t)
+	x := exporter.TopicConfig{
+		Topic:       "requests-x",
+		Measurement: "requests",
+		Type:        "counter",
+		ValueKey:    "x",
+	}
+	y := x
+	y.Topic = "requests-y"
+	y.ValueKey = "y"
+	if err := exporter.ValidateConfigs([]exporter.TopicConfig{x, y}); err != nil {
+		t.Fatal(err)
+	}
+	// the counters of the topics are kept apart, although they are
+	// written to the same measurement.
+	var got []string
+	for _, step := range []struct {
+		config exporter.TopicConfig
+		entry  string
+	}{
+		{x, `{"x": 100}`},
+		{y, `{"y": 5}`},
+		{x, `{"x": 110}`},
+		{y, `{"y": 8}`},
+	} {
+		w, err := processData(t, e, step.config, step.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, lines(w.Points())...)
+	}
+	assertLines(t, got,
+		"requests x=10 1000000000",
+		"requests y=3 1000000000",
+	)
+}
+
+func TestPrecision(t *testing.T) {
+	for _, precision := range []string{"", "ns", "s"} {
+		config := exporter.TopicConfig{
+			Topic:     "cpu",
+			Fields:    map[string]string{"a": "number"},
+			Precision: precision,
+		}
+		bp, err := newExporter(t).BuildPoints(config, entries(`{"a": 1}`), []time.Time{epoch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := precision
+		if expected == "" {
+			expected = "ms"
+		}
+		if bp.Precision() != expected {
+			t.Errorf("got precision %q, expected %q", bp.Precision(), expected)
+		}
+	}
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"a": "number"},
+		Precision: "h",
+	}
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected an error for precision %q", config.Precision)
+	}
+}
+
+func TestNestedFields(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "mem",
+		Fields: map[string]string{
+			"mem.heap.used": "number",
+			"mem.total":     "integer",
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"mem": {"heap": {"used": 3}, "total": 8}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "mem mem_heap_used=3,mem_total=8i 1000000000")
+
+	config.FieldSeparator = "."
+	got, err = buildPoints(t, newExporter(t), config, `{"mem": {"heap": {"used": 3}, "total": 8}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "mem mem.heap.used=3,mem.total=8i 1000000000")
+}
+
+func TestArrayIndexFields(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "cpu",
+		Fields: map[string]string{
+			"values[1]":      "number",
+			"load.avg[0][1]": "number",
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"values": [10, 20, 30], "load": {"avg": [[1, 2]]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu load_avg_0_1=2,values_1=20 1000000000")
+
+	// out of range indexes are missing keys.
+	logger := &logRecorder{}
+	if _, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"values": [10], "load": {"avg": [[1, 2]]}}`); err != nil {
+		t.Fatal(err)
+	}
+	if entryError := logger.entryError(exporter.ErrMissingKey); entryError == nil || entryError.Key != "values[1]" {
+		t.Errorf("got %q, expected a missing key error", logger.msgs)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+		Filter: &exporter.FilterConfig{
+			Key:    "env",
+			Values: []string{"prod", "staging"},
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"env": "dev", "a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got)
+
+	got, err = buildPoints(t, newExporter(t), config, `{"env": "staging", "a": 2}`, `{"a": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu a=2 1000000000")
+}
+
+func TestDatabase(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	bp, err := newExporter(t).BuildPoints(config, entries(`{"a": 1}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp.Database() != "kpi" || bp.RetentionPolicy() != "" {
+		t.Errorf("got database %q and retention policy %q, expected the defaults", bp.Database(), bp.RetentionPolicy())
+	}
+
+	config.Database = "metrics"
+	config.RetentionPolicy = "one_week"
+	bp, err = newExporter(t).BuildPoints(config, entries(`{"a": 1}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp.Database() != "metrics" || bp.RetentionPolicy() != "one_week" {
+		t.Errorf("got database %q and retention policy %q", bp.Database(), bp.RetentionPolicy())
+	}
+}
+
+func TestWriteConsistency(t *testing.T) {
+	config := numberConfig
+	w := &exportertest.RecordingWriter{}
+	if err := newExporter(t).ProcessData(context.Background(), config, w, numberEntries(1), []time.Time{epoch}); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.BatchPoints()[0].WriteConsistency(); c != "" {
+		t.Errorf("got write consistency %q, expected the server's default", c)
+	}
+
+	config.WriteConsistency = "quorum"
+	w = &exportertest.RecordingWriter{}
+	if err := newExporter(t).ProcessData(context.Background(), config, w, numberEntries(1), []time.Time{epoch}); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.BatchPoints()[0].WriteConsistency(); c != "quorum" {
+		t.Errorf("got write consistency %q, expected quorum", c)
+	}
+}
+
+func TestStats(t *testing.T) {
+	e := newExporter(t)
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number", "b": "number"},
+		Filter: &exporter.FilterConfig{
+			Key:    "env",
+			Values: []string{"prod"},
+		},
+	}
+	_, err := processData(t, e, config,
+		`{"env": "prod", "a": 1, "b": 2}`,
+		`{"env": "prod", "a": 1}`,
+		`{"env": "prod", "a": "x", "b": 2}`,
+		`{"env": "dev", "a": 1, "b": 2}`,
+		`{"env": "prod"`,
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	stats := e.Stats()["cpu"]
+	expected := exporter.TopicStats{
+		PointsWritten:   3,
+		EntriesFiltered: 1,
+		UnmarshalErrors: 1,
+		MissingKeys:     1,
+		InvalidValues:   1,
+	}
+	stats.WriteLatency = exporter.LatencyHistogram{}
+	if stats != expected {
+		t.Errorf("got stats %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "users",
+		Fields:    map[string]string{"name": "string"},
+		TagFields: []string{"region"},
+		Transforms: map[string][]string{
+			"name":   {"trim", "lower"},
+			"region": {"upper"},
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"name": " Foo ", "region": "eu"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, `users,region=EU name="foo" 1000000000`)
+}
+
+func TestNullValues(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "users",
+		Fields: map[string]string{"n": "number", "s": "string", "a": "number"},
+	}
+	// null values are written as absent fields, without errors.
+	got, err := buildPoints(t, newExporter(t), config, `{"n": null, "s": null, "a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "users a=1 1000000000")
+}
+
+func TestTimestamps(t *testing.T) {
+	e := newExporter(t)
+	data := entries(`{"a": 1}`, `{"a": 2}`)
+	// each entry has its own time.
+	bp, err := e.BuildPoints(numberConfig, data, []time.Time{time.Unix(1, 0), time.Unix(2, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(bp.Points()),
+		"cpu a=1 1000000000",
+		"cpu a=2 2000000000",
+	)
+	// a single time applies to all entries.
+	bp, err = e.BuildPoints(numberConfig, data, []time.Time{time.Unix(3, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(bp.Points()),
+		"cpu a=1 3000000000",
+		"cpu a=2 3000000000",
+	)
+	w := &exportertest.RecordingWriter{}
+	err = e.ProcessData(context.Background(), numberConfig, w, entries(`{"a": 1}`, `{"a": 2}`, `{"a": 3}`), []time.Time{epoch, epoch})
+	if err == nil || err.Error() != "got 2 timestamps for 3 entries" {
+		t.Errorf("got %v, expected a timestamp mismatch error", err)
+	}
+	if len(w.Points()) != 0 {
+		t.Errorf("got points written despite the mismatch")
+	}
+}
+
+func TestTimestampField(t *testing.T) {
+	tests := []struct {
+		format   string
+		value    string
+		expected string
+	}{
+		{"", `"2019-03-01T10:00:00Z"`, "1551434400000000000"},
+		{"2006-01-02 15:04:05", `"2019-03-01 10:00:00"`, "1551434400000000000"},
+		{"unix", `1551434400`, "1551434400000000000"},
+		{"unix", `"1551434400"`, "1551434400000000000"},
+		{"unixms", `1551434400000`, "1551434400000000000"},
+		// non-round values are converted exactly.
+		{"unixms", `1700000000001`, "1700000000001000000"},
+		{"unixms", `1700000000001.5`, "1700000000001500000"},
+		{"unix", `1700000000.123`, "1700000000123000000"},
+		{"unix", `"1700000000.123456789"`, "1700000000123456789"},
+		{"unix", `-1.5`, "-1500000000"},
+		{"unix", `1.7e9`, "1700000000000000000"},
+		// out of range values fall back to the entry time.
+		{"unixms", `99999999999999999`, "1000000000"},
+		{"unix", `-9999999999999`, "1000000000"},
+		{"unix", `"9223372036.854775808"`, "1000000000"},
+		{"unix", `1e300`, "1000000000"},
+		{"unixms", `-1e17`, "1000000000"},
+	}
+	for _, test := range tests {
+		t.Run(test.format+" "+test.value, func(t *testing.T) {
+			config := exporter.TopicConfig{
+				Topic:           "cpu",
+				Fields:          map[string]string{"a": "number"},
+				TimestampField:  "time",
+				TimestampFormat: test.format,
+				Precision:       "ns",
+			}
+			got, err := buildPoints(t, newExporter(t), config, `{"a": 1, "time": `+test.value+`}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertLines(t, got, "cpu a=1 "+test.expected)
+		})
+	}
+}
+
+func TestTimestampFieldFallback(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:          "cpu",
+		Fields:         map[string]string{"a": "number"},
+		TimestampField: "time",
+	}
+	logger := &logRecorder{}
+	got, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config,
+		`{"a": 1, "time": "yesterday"}`,
+		`{"a": 2}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entry time is used when the timestamp field is missing or
+	// invalid.
+	if entryError := logger.entryError(exporter.ErrMissingKey); entryError == nil || entryError.Key != "time" {
+		t.Errorf("got %q, expected a missing key error", logger.msgs)
+	}
+	assertLines(t, got, "cpu a=1 1000000000", "cpu a=2 1000000000")
+	if !logger.contains("failed to parse timestamp yesterday") {
+		t.Errorf("the invalid timestamp is not logged: %q", logger.msgs)
+	}
+}
+
+func TestSubMeasurements(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "host",
+		Fields:    map[string]string{"cpu": "number"},
+		TagFields: []string{"name"},
+		SubMeasurements: []exporter.MeasurementConfig{{
+			Measurement: "mem",
+			Fields:      map[string]string{"used": "number", "total": "number"},
+		}},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"name": "a", "cpu": 0.5, "used": 1, "total": 4}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sub-measurement points share the tags and time of the entry.
+	assertLines(t, got,
+		"host,name=a cpu=0.5 1000000000",
+		"mem,name=a total=4,used=1 1000000000",
+	)
+}
+
+func TestSet(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "users",
+		Type:      "set",
+		ValueKey:  "user",
+		FieldName: "distinct",
+		TagFields: []string{"site"},
+	}
+	bp, err := newExporter(t).BuildPoints(config, entries(
+		`{"site": "x", "user": "a"}`,
+		`{"site": "x", "user": "a"}`,
+		`{"site": "x", "user": "b"}`,
+		`{"site": "y", "user": "a"}`,
+	), []time.Time{time.Unix(1, 0), time.Unix(3, 0), time.Unix(2, 0), time.Unix(1, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each series is written at the time of its latest entry.
+	assertLines(t, lines(bp.Points()),
+		"users,site=x distinct=2i 3000000000",
+		"users,site=y distinct=1i 1000000000",
+	)
+}
+
+func TestDefaults(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "cpu",
+		Fields: map[string]string{
+			"a":   "number",
+			"foo": "number",
+			"n":   "integer",
+			"s":   "string",
+		},
+		Defaults: map[string]string{
+			"foo": "0",
+			"n":   "-1",
+			"s":   "none",
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config,
+		`{"a": 1}`,
+		`{"a": 2, "foo": 3, "n": 4, "s": "x"}`,
+		`{"a": 3, "foo": null, "n": null, "s": null}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// null values are replaced by the defaults, like missing keys.
+	assertLines(t, got,
+		`cpu a=1,foo=0,n=-1i,s="none" 1000000000`,
+		`cpu a=2,foo=3,n=4i,s="x" 1000000000`,
+		`cpu a=3,foo=0,n=-1i,s="none" 1000000000`,
+	)
+}
+
+func TestCSV(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:   "test-topic",
+		Format:  "csv",
+		Columns: []string{"a", "b", "c"},
+		Fields: map[string]string{
+			"a": "integer",
+			"b": "string",
+			"c": "number",
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `42,just a string,5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, `test-topic a=42i,b="just a string",c=5 1000000000`)
+
+	// NaN columns are strings, not numbers.
+	logger := &logRecorder{}
+	got, err = buildPoints(t, &exporter.Exporter{Logger: logger}, config, `42,NaN,NaN`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+		t.Errorf("got %q, expected a field type mismatch error", logger.msgs)
+	}
+	assertLines(t, got, `test-topic a=42i,b="NaN" 1000000000`)
+}
+
+func TestDedupKey(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:    "cpu",
+		Fields:   map[string]string{"a": "number"},
+		DedupKey: "id",
+	}
+	got, err := buildPoints(t, newExporter(t), config,
+		`{"id": "x", "a": 1}`,
+		`{"id": "x", "a": 2}`,
+		`{"id": "y", "a": 3}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got,
+		"cpu a=1 1000000000",
+		"cpu a=3 1000000000",
+	)
+}
+
+func TestFieldPrefix(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:       "cpu",
+		Fields:      map[string]string{"a": "number"},
+		TagFields:   []string{"host"},
+		FieldPrefix: "app_",
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"a": 1, "host": "h"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tags and measurements are not prefixed.
+	assertLines(t, got, "cpu,host=h app_a=1 1000000000")
+}
+
+func TestBuildPoints(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	data := entries(`{"a": 1}`, `{`, `{"a": 2}`)
+	bp, err := newExporter(t).BuildPoints(config, data, []time.Time{epoch})
+	if _, ok := err.(exporter.ProcessErrors); !ok {
+		t.Fatalf("got %v, expected ProcessErrors", err)
+	}
+	// the batch holds the points ProcessData writes.
+	w := &exportertest.RecordingWriter{}
+	err = newExporter(t).ProcessData(context.Background(), config, w, data, []time.Time{epoch})
+	if _, ok := err.(exporter.ProcessErrors); !ok {
+		t.Fatalf("got %v, expected ProcessErrors", err)
+	}
+	assertLines(t, lines(bp.Points()), lines(w.Points())...)
+	assertLines(t, lines(bp.Points()),
+		"cpu a=1 1000000000",
+		"cpu a=2 1000000000",
+	)
+}
+
+func TestCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := &exportertest.RecordingWriter{}
+	err := newExporter(t).ProcessData(ctx, numberConfig, w, entries(`{"a": 1}`, `{"a": 2}`), []time.Time{epoch})
+	if jujuerrors.Cause(err) != context.Canceled {
+		t.Errorf("got %v, expected the context error", err)
+	}
+	if n := len(w.BatchPoints()); n != 0 {
+		t.Errorf("got %d writes with a canceled context", n)
+	}
+}
+
+func TestTimeBucket(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:      "cpu",
+		Fields:     map[string]string{"a": "number"},
+		TimeBucket: time.Minute,
+	}
+	minute := time.Date(2019, 1, 1, 10, 5, 0, 0, time.UTC)
+	bp, err := newExporter(t).BuildPoints(config, entries(`{"a": 1}`, `{"a": 2}`, `{"a": 3}`), []time.Time{
+		minute.Add(time.Second),
+		minute.Add(59 * time.Second),
+		minute.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := bp.Points()
+	if !points[0].Time().Equal(minute) || !points[1].Time().Equal(minute) {
+		t.Errorf("got times %v and %v, expected %v", points[0].Time(), points[1].Time(), minute)
+	}
+	if !points[2].Time().Equal(minute.Add(time.Minute)) {
+		t.Errorf("got time %v of the next minute", points[2].Time())
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "cpu",
+		Fields: map[string]string{
+			"usr": "integer",
+			"sys": "number",
+		},
+		FieldNames: map[string]string{"usr": "user"},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"usr": 2, "sys": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the type of the renamed field is still looked up by its key.
+	assertLines(t, got, "cpu sys=1,user=2i 1000000000")
+}
+
+func TestArrayPayload(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:        "cpu",
+		Fields:       map[string]string{"a": "number"},
+		ArrayPayload: true,
+	}
+	got, err := buildPoints(t, newExporter(t), config, `[{"a": 1}, {"a": 2}, {"a": 3}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got,
+		"cpu a=1 1000000000",
+		"cpu a=2 1000000000",
+		"cpu a=3 1000000000",
+	)
+}
+
+func TestScale(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "mem",
+		Fields: map[string]string{"bytes": "number", "n": "number"},
+		Scale:  map[string]float64{"bytes": 9.5367e-7},
+	}
+	bp, err := newExporter(t).BuildPoints(config, entries(`{"bytes": 1048576, "n": 2}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := bp.Points()[0].Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mb := fields["bytes"].(float64); math.Abs(mb-1) > 1e-4 {
+		t.Errorf("got %v, expected about 1", mb)
+	}
+	if n := fields["n"].(float64); n != 2 {
+		t.Errorf("got unscaled value %v, expected 2", n)
+	}
+}
+
+func TestEmptyTagMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		value    string
+		expected []string
+	}{{
+		mode:     "",
+		expected: []string{"cpu a=1 1000000000", "cpu,host=x a=2 1000000000"},
+	}, {
+		mode:     "drop",
+		expected: []string{"cpu a=1 1000000000", "cpu,host=x a=2 1000000000"},
+	}, {
+		mode:     "placeholder",
+		expected: []string{"cpu,host=unknown a=1 1000000000", "cpu,host=x a=2 1000000000"},
+	}, {
+		mode:     "placeholder",
+		value:    "none",
+		expected: []string{"cpu,host=none a=1 1000000000", "cpu,host=x a=2 1000000000"},
+	}, {
+		mode:     "skip",
+		expected: []string{"cpu,host=x a=2 1000000000"},
+	}}
+	for _, test := range tests {
+		t.Run(test.mode+test.value, func(t *testing.T) {
+			config := exporter.TopicConfig{
+				Topic:         "cpu",
+				Fields:        map[string]string{"a": "number"},
+				TagFields:     []string{"host"},
+				EmptyTagMode:  test.mode,
+				EmptyTagValue: test.value,
+			}
+			// null values are handled as empty ones.
+			for _, empty := range []string{`""`, `null`} {
+				got, err := buildPoints(t, newExporter(t), config,
+					`{"a": 1, "host": `+empty+`}`,
+					`{"a": 2, "host": "x"}`,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertLines(t, got, test.expected...)
+			}
+		})
+	}
+}
+
+func TestKeyTag(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+		KeyTag: "host",
+	}
+	w := &exportertest.RecordingWriter{}
+	keys := [][]byte{[]byte("host-a"), nil, []byte("host b")}
+	err := newExporter(t).ProcessDataWithKeys(context.Background(), config, w, keys, entries(`{"a": 1}`, `{"a": 2}`, `{"a": 3}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// entries without a key are written without the tag.
+	assertLines(t, lines(w.Points()),
+		"cpu,host=host-a a=1 1000000000",
+		"cpu a=2 1000000000",
+		`cpu,host=host\ b a=3 1000000000`,
+	)
+
+	err = newExporter(t).ProcessDataWithKeys(context.Background(), config, w, keys[:1], entries(`{"a": 1}`, `{"a": 2}`), []time.Time{epoch})
+	if err == nil || !strings.Contains(err.Error(), "got 1 keys for 2 entries") {
+		t.Errorf("got %v, expected a key count error", err)
+	}
+}
+
+func TestHeaderTags(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:      "cpu",
+		Fields:     map[string]string{"a": "number"},
+		HeaderTags: []string{"source"},
+	}
+	w := &exportertest.RecordingWriter{}
+	headers := []map[string][]byte{
+		{"source": []byte("agent"), "trace": []byte("x")},
+		{"trace": []byte("y")},
+		nil,
+	}
+	err := newExporter(t).ProcessDataWithHeaders(context.Background(), config, w, nil, headers, numberEntries(3), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// missing headers are skipped, and the headers not selected are
+	// not written.
+	assertLines(t, lines(w.Points()),
+		"cpu,source=agent a=1 1000000000",
+		"cpu a=2 1000000000",
+		"cpu a=3 1000000000",
+	)
+}
+
+func TestMaxAge(t *testing.T) {
+	logger := &logRecorder{}
+	e := &exporter.Exporter{
+		Logger: logger,
+		Clock:  testclock.NewClock(epoch.Add(time.Hour)),
+	}
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+		MaxAge: 10 * time.Minute,
+	}
+	bp, err := e.BuildPoints(config, entries(`{"a": 1}`, `{"a": 2}`), []time.Time{epoch, epoch.Add(55 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(bp.Points()), "cpu a=2 3301000000000")
+	if !logger.contains("older than 10m0s") {
+		t.Errorf("the old entry is not logged: %q", logger.msgs)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "req",
+		Fields: map[string]string{
+			"latency": "number",
+			"retries": "number",
+			"code":    "number",
+		},
+		Conditions: map[string]exporter.ConditionConfig{
+			"latency": {Key: "phase", Operator: "==", Value: "complete"},
+			"retries": {Key: "phase", Operator: "!=", Value: "start"},
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config,
+		`{"phase": "complete", "code": 200, "latency": 5, "retries": 1}`,
+		`{"phase": "start", "code": 100, "latency": 1, "retries": 0}`,
+		`{"phase": "running", "code": 100, "latency": 2, "retries": 2}`,
+		`{"code": 500, "latency": 3, "retries": 3}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// conditions do not hold for entries without the condition key.
+	assertLines(t, got,
+		"req code=200,latency=5,retries=1 1000000000",
+		"req code=100 1000000000",
+		"req code=100,retries=2 1000000000",
+		"req code=500 1000000000",
+	)
+}
+
+func TestTransform(t *testing.T) {
+	e := newExporter(t)
+	e.Transform = func(point *client.Point) (*client.Point, error) {
+		fields, err := point.Fields()
+		if err != nil {
+			return nil, err
+		}
+		tags := point.Tags()
+		tags["source"] = "transform"
+		return client.NewPoint(point.Name(), tags, fields, point.Time())
+	}
+	got, err := buildPoints(t, e, numberConfig, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu,source=transform a=1 1000000000")
+
+	// returning nil drops the point.
+	n := 0
+	e.Transform = func(point *client.Point) (*client.Point, error) {
+		n++
+		if n%2 == 0 {
+			return nil, nil
+		}
+		return point, nil
+	}
+	w := &exportertest.RecordingWriter{}
+	if err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(4), []time.Time{epoch}); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "cpu a=1 1000000000", "cpu a=3 1000000000")
+
+	// an error aborts the call.
+	e.Transform = func(point *client.Point) (*client.Point, error) {
+		return nil, errors.New("no transform")
+	}
+	w = &exportertest.RecordingWriter{}
+	err = e.ProcessData(context.Background(), numberConfig, w, numberEntries(2), []time.Time{epoch})
+	if err == nil || !strings.Contains(err.Error(), `failed to transform a point of topic "cpu": no transform`) {
+		t.Errorf("got %v, expected the transform error", err)
+	}
+	if len(w.Points()) != 0 {
+		t.Errorf("got points %q, expected none", lines(w.Points()))
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:   "host",
+		Flatten: true,
+	}
+	entry := `{"a": {"b": {"c": 1, "s": "x"}, "l": [true, 2], "n": 3}, "d": 1.5}`
+	got, err := buildPoints(t, newExporter(t), config, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, `host a_b_c=1,a_b_s="x",a_l_0=true,a_l_1=2,a_n=3,d=1.5 1000000000`)
+
+	logger := &logRecorder{}
+	// the nested objects and arrays deeper than the maximum depth are
+	// not written.
+	config.MaxDepth = 2
+	got, err = buildPoints(t, &exporter.Exporter{Logger: logger}, config, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "host a_n=3,d=1.5 1000000000")
+	if !logger.contains("not flattening a_b beyond depth 2") || !logger.contains("not flattening a_l beyond depth 2") {
+		t.Errorf("the nesting is not logged: %q", logger.msgs)
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	config := numberConfig
+	config.SampleRate = 0.5
+	written := func(seed int64) []string {
+		e := newExporter(t)
+		e.Rand = rand.New(rand.NewSource(seed)).Float64
+		w := &exportertest.RecordingWriter{}
+		if err := e.ProcessData(context.Background(), config, w, numberEntries(1000), []time.Time{epoch}); err != nil {
+			t.Fatal(err)
+		}
+		return lines(w.Points())
+	}
+	got := written(42)
+	if n := len(got); n < 450 || n > 550 {
+		t.Errorf("got %d of 1000 entries written, expected about half", n)
+	}
+	// the same source selects the same entries.
+	if again := written(42); strings.Join(again, "\n") != strings.Join(got, "\n") {
+		t.Error("the sampled entries are not deterministic")
+	}
+}
+
+func TestCoerceFloat(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:       "cpu",
+		Fields:      map[string]string{"a": "number", "n": "integer?"},
+		CoerceFloat: true,
+	}
+	bp, err := newExporter(t).BuildPoints(config, entries(`{"a": 1}`, `{"a": 1.5, "n": 2}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(bp.Points()), "cpu a=1 1000000000", "cpu a=1.5,n=2 1000000000")
+	for i, point := range bp.Points() {
+		fields, err := point.Fields()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range fields {
+			if _, ok := value.(float64); !ok {
+				t.Errorf("field %q of point %d is %T, expected float64", name, i, value)
+			}
+		}
+	}
+}
+
+func TestDedupPoints(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:       "cpu",
+		Fields:      map[string]string{"a": "number"},
+		TagFields:   []string{"host"},
+		DedupPoints: true,
+	}
+	data := []string{
+		`{"host": "x", "a": 1, "id": 1}`,
+		`{"host": "x", "a": 1, "id": 2}`,
+		`{"host": "y", "a": 1, "id": 3}`,
+		`{"host": "x", "a": 2, "id": 4}`,
+	}
+	w, err := processData(t, newExporter(t), config, data...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()),
+		"cpu,host=x a=1 1000000000",
+		"cpu,host=y a=1 1000000000",
+		"cpu,host=x a=2 1000000000",
+	)
+
+	config.DedupPoints = false
+	w, err = processData(t, newExporter(t), config, data...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Points()); n != 4 {
+		t.Errorf("got %d points, expected 4 without deduplication", n)
+	}
+}
+
+func TestValueMaps(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "service",
+		Fields: map[string]string{"status": "string"},
+		ValueMaps: map[string]map[string]string{
+			"status": {"1": "ok", "2": "degraded"},
+		},
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"status": 2}`, `{"status": 1}`, `{"status": "7"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unmapped values are written as they are.
+	assertLines(t, got,
+		`service status="degraded" 1000000000`,
+		`service status="ok" 1000000000`,
+		`service status="7" 1000000000`,
+	)
+}
+
+func TestSortByTime(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:      "cpu",
+		Fields:     map[string]string{"a": "number"},
+		SortByTime: true,
+	}
+	timestamps := []time.Time{
+		epoch.Add(2 * time.Second),
+		epoch,
+		epoch.Add(time.Second),
+		epoch,
+	}
+	w := &exportertest.RecordingWriter{}
+	if err := newExporter(t).ProcessData(context.Background(), config, w, numberEntries(4), timestamps); err != nil {
+		t.Fatal(err)
+	}
+	// points with the same timestamp keep their order.
+	assertLines(t, lines(w.Points()),
+		"cpu a=2 1000000000",
+		"cpu a=4 1000000000",
+		"cpu a=3 2000000000",
+		"cpu a=1 3000000000",
+	)
+}
+
+func TestTopicRegex(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:      "metrics.region-eu.host-db01",
+		Fields:     map[string]string{"a": "number"},
+		Tags:       map[string]string{"env": "prod"},
+		TopicRegex: `^metrics\.region-(?P<region>[^.]+)\.host-(?P<host>.+)$`,
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "metrics.region-eu.host-db01,env=prod,host=db01,region=eu a=1 1000000000")
+
+	logger := &logRecorder{}
+	config.Topic = "metrics.eu"
+	got, err = buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "metrics.eu,env=prod a=1 1000000000")
+	if !logger.contains("topic metrics.eu does not match") {
+		t.Errorf("the topic mismatch is not logged: %q", logger.msgs)
+	}
+}
+
+func TestFallbackKeys(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "req",
+		Fields: map[string]string{"latency_ms|latencyMs": "number"},
+	}
+	got, err := buildPoints(t, newExporter(t), config,
+		`{"latency_ms": 5}`,
+		`{"latencyMs": 7}`,
+		`{"latency_ms": 1, "latencyMs": 2}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got,
+		"req latency_ms=5 1000000000",
+		"req latency_ms=7 1000000000",
+		"req latency_ms=1 1000000000",
+	)
+
+	logger := &logRecorder{}
+	buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"latency": 1}`)
+	if logger.entryError(exporter.ErrMissingKey) == nil {
+		t.Errorf("got %q, expected a missing key error", logger.msgs)
+	}
+}
+
+func TestRequireAllFields(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "mem",
+		Fields: map[string]string{
+			"used":  "number",
+			"total": "number",
+			"cache": "number?",
+		},
+		RequireAllFields: true,
+	}
+	logger := &logRecorder{}
+	got, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config,
+		`{"used": 1, "total": 4}`,
+		`{"used": 2}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entryError := logger.entryError(exporter.ErrMissingKey); entryError == nil || entryError.Key != "total" {
+		t.Errorf("got %q, expected a missing key error", logger.msgs)
+	}
+	// no partial point is written, but optional fields may be missing.
+	assertLines(t, got, "mem total=4,used=1 1000000000")
+	if !logger.contains("entry key not found: total") {
+		t.Errorf("the missing field is not logged: %q", logger.msgs)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Root:      "payload",
+		Fields:    map[string]string{"a": "number", "h": "hist"},
+		TagFields: []string{"host"},
+	}
+	got, err := buildPoints(t, newExporter(t), config,
+		`{"meta": {"host": "meta", "a": 9}, "payload": {"host": "x", "a": 1, "h": {"10": 2}}}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "cpu,host=x 10=2,a=1 1000000000")
+
+	// entries without the root object are skipped.
+	logger := &logRecorder{}
+	got, err = buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"a": 1}`, `{"payload": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entryError := logger.entryError(exporter.ErrMissingKey); entryError == nil || entryError.Key != "payload" {
+		t.Errorf("got %q, expected a missing root error", logger.msgs)
+	}
+	if logger.entryError(exporter.ErrFieldTypeMismatch) == nil {
+		t.Errorf("got %q, expected an invalid root error", logger.msgs)
+	}
+	assertLines(t, got)
+}
+
+func TestClamp(t *testing.T) {
+	zero, hundred := 0.0, 100.0
+	logger := &logRecorder{}
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number", "pct": "number?"},
+		Clamp: map[string]exporter.ClampConfig{
+			"a":   {Min: &zero},
+			"pct": {Min: &zero, Max: &hundred, Log: true},
+		},
+	}
+	got, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config,
+		`{"a": -5}`,
+		`{"a": 3, "pct": 120}`,
+		`{"a": 4, "pct": 50}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got,
+		"cpu a=0 1000000000",
+		"cpu a=3,pct=100 1000000000",
+		"cpu a=4,pct=50 1000000000",
+	)
+	if !logger.contains("clamping value 120 of field pct to 100") {
+		t.Errorf("the clamped value is not logged: %q", logger.msgs)
+	}
+	if logger.contains("clamping value -5") {
+		t.Errorf("the clamped value logged without Log: %q", logger.msgs)
+	}
+}
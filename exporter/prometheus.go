@@ -0,0 +1,280 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/errors"
+)
+
+// PrometheusConfig holds the configuration of a writer writing points
+// to a Prometheus remote-write endpoint.
+type PrometheusConfig struct {
+	// URL holds the address of the remote-write endpoint, e.g.
+	// "http://localhost:9090/api/v1/write".
+	URL string `yaml:"url"`
+	// Username and Password, if set, hold the basic authentication
+	// credentials of the requests.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// BearerToken, if set, holds the token sent in the Authorization
+	// header of the requests.
+	BearerToken string `yaml:"bearer-token,omitempty"`
+
+	// HTTPClient, if set, is used to send the requests. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client `yaml:"-"`
+}
+
+type prometheusWriter struct {
+	config PrometheusConfig
+}
+
+// NewPrometheusWriter returns a writer writing points to a Prometheus
+// remote-write endpoint. Each numeric or boolean field of a point is
+// written as a sample of the series named after the measurement and
+// the field, e.g. the "user" field of the "cpu" measurement is written
+// to the "cpu_user" series, labeled with the point tags. String fields
+// are not written.
+func NewPrometheusWriter(config PrometheusConfig) (Writer, error) {
+	if config.URL == "" {
+		return nil, errors.New("prometheus remote-write url not specified")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &prometheusWriter{
+		config: config,
+	}, nil
+}
+
+// Write implements the Writer interface.
+func (w *prometheusWriter) Write(bp client.BatchPoints) error {
+	body, err := encodeWriteRequest(bp.Points())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req, err := http.NewRequest("POST", w.config.URL, bytes.NewReader(snappy.Encode(nil, body)))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.config.Username != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+	if w.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.BearerToken)
+	}
+
+	resp, err := w.config.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Trace(&WriteError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("prometheus remote write failed with status %s: %s", resp.Status, body),
+		})
+	}
+	return nil
+}
+
+// promLabel holds a label of a Prometheus time series.
+type promLabel struct {
+	name  string
+	value string
+}
+
+// promSample holds a sample of a Prometheus time series.
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+// promSeries holds a Prometheus time series.
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+// encodeWriteRequest returns the protobuf encoding of the Prometheus
+// remote-write request holding the samples of the points.
+func encodeWriteRequest(points []*client.Point) ([]byte, error) {
+	var series []*promSeries
+	index := make(map[string]*promSeries)
+	for _, point := range points {
+		if point == nil {
+			continue
+		}
+		fields, err := point.Fields()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		timestamp := point.Time().UnixNano() / 1e6
+		for field, value := range fields {
+			sample, ok := sampleValue(value)
+			if !ok {
+				continue
+			}
+			labels := seriesLabels(point.Name()+"_"+field, point.Tags())
+			key := labelsKey(labels)
+			s, ok := index[key]
+			if !ok {
+				s = &promSeries{labels: labels}
+				index[key] = s
+				series = append(series, s)
+			}
+			s.samples = append(s.samples, promSample{
+				value:     sample,
+				timestamp: timestamp,
+			})
+		}
+	}
+
+	var req []byte
+	for _, s := range series {
+		// Prometheus rejects the samples older than the previous
+		// sample of the series.
+		sort.SliceStable(s.samples, func(i, j int) bool {
+			return s.samples[i].timestamp < s.samples[j].timestamp
+		})
+		var ts []byte
+		for _, label := range s.labels {
+			var l []byte
+			l = appendString(l, 1, label.name)
+			l = appendString(l, 2, label.value)
+			ts = appendBytes(ts, 1, l)
+		}
+		for _, sample := range s.samples {
+			var b []byte
+			b = appendKey(b, 1, 1)
+			b = appendFixed64(b, math.Float64bits(sample.value))
+			b = appendKey(b, 2, 0)
+			b = appendVarint(b, uint64(sample.timestamp))
+			ts = appendBytes(ts, 2, b)
+		}
+		req = appendBytes(req, 1, ts)
+	}
+	return req, nil
+}
+
+// sampleValue converts the field value to the value of a sample.
+func sampleValue(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// seriesLabels returns the labels of the series with the given name and
+// tags, sorted by label name as required by the remote-write protocol.
+// Tags whose names are written as the same label name, e.g. "host.name"
+// and "host_name", are merged: the label holds the value of the tag
+// whose name sorts first. Tags written as the "__name__" label are
+// dropped.
+func seriesLabels(name string, tags map[string]string) []promLabel {
+	labels := []promLabel{{
+		name:  "__name__",
+		value: promName(name),
+	}}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	names := map[string]bool{"__name__": true}
+	for _, k := range keys {
+		labelName := promName(k)
+		if names[labelName] {
+			continue
+		}
+		names[labelName] = true
+		labels = append(labels, promLabel{
+			name:  labelName,
+			value: tags[k],
+		})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	return labels
+}
+
+// labelsKey returns a key identifying the series with the given labels.
+func labelsKey(labels []promLabel) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label.name + "=" + label.value
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// promName replaces the characters not allowed in Prometheus metric and
+// label names with underscores.
+func promName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c == '_' || c == ':':
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// appendKey appends the protobuf key of the field with the given number
+// and wire type.
+func appendKey(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+// appendVarint appends the varint encoding of v.
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendFixed64 appends the little-endian encoding of v.
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// appendBytes appends the length-delimited protobuf field.
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendKey(b, field, 2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendString appends the protobuf string field.
+func appendString(b []byte, field int, v string) []byte {
+	return appendBytes(b, field, []byte(v))
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+// protoField holds a field of a protobuf message.
+type protoField struct {
+	number int
+	// value holds the value of varint and fixed64 fields.
+	value uint64
+	// bytes holds the value of length-delimited fields.
+	bytes []byte
+}
+
+// decodeMessage returns the fields of the protobuf message.
+func decodeMessage(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid field key in %x", b)
+		}
+		b = b[n:]
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			field.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid varint in %x", b)
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				t.Fatalf("invalid fixed64 in %x", b)
+			}
+			field.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				t.Fatalf("invalid length in %x", b)
+			}
+			field.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// decodeWriteRequest returns the series of the remote-write request in
+// the "name{label="value",...} value@timestamp ..." format, sorted.
+func decodeWriteRequest(t *testing.T, body []byte) []string {
+	t.Helper()
+	var series []string
+	for _, ts := range decodeMessage(t, body) {
+		if ts.number != 1 {
+			t.Fatalf("unexpected write request field %d", ts.number)
+		}
+		var name string
+		var labels, samples []string
+		for _, f := range decodeMessage(t, ts.bytes) {
+			switch f.number {
+			case 1:
+				var labelName, labelValue string
+				for _, l := range decodeMessage(t, f.bytes) {
+					switch l.number {
+					case 1:
+						labelName = string(l.bytes)
+					case 2:
+						labelValue = string(l.bytes)
+					}
+				}
+				if labelName == "__name__" {
+					name = labelValue
+				} else {
+					labels = append(labels, fmt.Sprintf("%s=%q", labelName, labelValue))
+				}
+			case 2:
+				var value float64
+				var timestamp int64
+				for _, s := range decodeMessage(t, f.bytes) {
+					switch s.number {
+					case 1:
+						value = math.Float64frombits(s.value)
+					case 2:
+						timestamp = int64(s.value)
+					}
+				}
+				samples = append(samples, fmt.Sprintf("%v@%d", value, timestamp))
+			}
+		}
+		series = append(series, fmt.Sprintf("%s{%s} %s", name, strings.Join(labels, ","), strings.Join(samples, " ")))
+	}
+	sort.Strings(series)
+	return series
+}
+
+func TestPrometheusWriter(t *testing.T) {
+	srv, requests := stubServer(http.StatusNoContent)
+	defer srv.Close()
+	w, err := exporter.NewPrometheusWriter(exporter.PrometheusConfig{
+		URL:         srv.URL + "/api/v1/write",
+		BearerToken: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"user": "number", "busy": "boolean", "s": "string"},
+		TagFields: []string{"host"},
+	}
+	bp, err := newExporter(t).BuildPoints(config, entries(
+		`{"host": "a", "user": 0.5, "busy": true, "s": "x"}`,
+		`{"host": "b", "user": 2, "busy": false, "s": "y"}`,
+		`{"host": "a", "user": 1.5, "busy": false, "s": "z"}`,
+	), []time.Time{epoch, epoch, epoch.Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(bp); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != "POST" || req.path != "/api/v1/write" {
+		t.Errorf("got %s %s", req.method, req.path)
+	}
+	for header, expected := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Bearer secret",
+	} {
+		if got := req.header.Get(header); got != expected {
+			t.Errorf("got %s header %q, expected %q", header, got, expected)
+		}
+	}
+	body, err := snappy.Decode(nil, []byte(req.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// string fields are not written, and the samples of each series
+	// are grouped.
+	got := decodeWriteRequest(t, body)
+	expected := []string{
+		`cpu_busy{host="a"} 1@1000 0@2000`,
+		`cpu_busy{host="b"} 0@1000`,
+		`cpu_user{host="a"} 0.5@1000 1.5@2000`,
+		`cpu_user{host="b"} 2@1000`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got series\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestPrometheusWriterOrder(t *testing.T) {
+	srv, requests := stubServer(http.StatusNoContent)
+	defer srv.Close()
+	w, err := exporter.NewPrometheusWriter(exporter.PrometheusConfig{
+		URL: srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := exporter.TopicConfig{
+		Topic:     "cpu",
+		Fields:    map[string]string{"user": "number"},
+		TagFields: []string{"host.name", "host_name", "__name__"},
+	}
+	bp, err := newExporter(t).BuildPoints(config, entries(
+		`{"host.name": "a", "host_name": "b", "__name__": "x", "user": 2}`,
+		`{"host.name": "a", "host_name": "b", "__name__": "x", "user": 1}`,
+	), []time.Time{epoch.Add(time.Second), epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(bp); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	body, err := snappy.Decode(nil, []byte(req.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the samples are sorted by timestamp, and the tags written as the
+	// same label are merged.
+	got := decodeWriteRequest(t, body)
+	expected := []string{
+		`cpu_user{host_name="a"} 1@1000 2@2000`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got series\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestPrometheusWriterError(t *testing.T) {
+	srv, requests := stubServer(http.StatusBadRequest)
+	defer srv.Close()
+	w, err := exporter.NewPrometheusWriter(exporter.PrometheusConfig{
+		URL:      srv.URL,
+		Username: "admin",
+		Password: "pass",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := newExporter(t).BuildPoints(numberConfig, numberEntries(1), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(bp)
+	if err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("got %v, expected a status error", err)
+	}
+	req := <-requests
+	if auth := req.header.Get("Authorization"); !strings.HasPrefix(auth, "Basic ") {
+		t.Errorf("got authorization %q, expected basic authentication", auth)
+	}
+
+	if _, err := exporter.NewPrometheusWriter(exporter.PrometheusConfig{}); err == nil {
+		t.Error("expected an error without url")
+	}
+}
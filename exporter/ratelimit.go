@@ -0,0 +1,83 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"context"
+	"math"
+
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter limits the rate of written points. It is a token bucket
+// holding at most a second worth of points, which is full initially.
+// Writes larger than the bucket are allowed, and delay the following
+// writes accordingly.
+type rateLimiter struct {
+	clock   clock.Clock
+	burst   int
+	limiter *rate.Limiter
+}
+
+func newRateLimiter(clk clock.Clock, pointsPerSecond float64) *rateLimiter {
+	burst := int(math.Ceil(pointsPerSecond))
+	return &rateLimiter{
+		clock:   clk,
+		burst:   burst,
+		limiter: rate.NewLimiter(rate.Limit(pointsPerSecond), burst),
+	}
+}
+
+// wait blocks until n points can be written, or the context is
+// canceled. The time of the exporter's clock is used rather than
+// rate.Limiter.WaitN, which uses the wall clock.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	now := l.clock.Now()
+	// rate.Limiter rejects reservations larger than the bucket, so
+	// the points are reserved by bucket sized chunks.
+	var reservations []*rate.Reservation
+	for n > 0 {
+		chunk := n
+		if chunk > l.burst {
+			chunk = l.burst
+		}
+		reservations = append(reservations, l.limiter.ReserveN(now, chunk))
+		n -= chunk
+	}
+	if len(reservations) == 0 {
+		return nil
+	}
+	delay := reservations[len(reservations)-1].DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		// the points are not written, so give back their tokens,
+		// latest reservation first.
+		now := l.clock.Now()
+		for i := len(reservations) - 1; i >= 0; i-- {
+			reservations[i].CancelAt(now)
+		}
+		return errors.Trace(ctx.Err())
+	case <-l.clock.After(delay):
+		return nil
+	}
+}
+
+// waitRateLimit blocks until n points can be written without exceeding
+// the exporter's rate limit, or the context is canceled.
+func (e *Exporter) waitRateLimit(ctx context.Context, n int) error {
+	if e.PointsPerSecond <= 0 {
+		return nil
+	}
+	e.muLimiter.Lock()
+	if e.limiter == nil {
+		e.limiter = newRateLimiter(e.clock(), e.PointsPerSecond)
+	}
+	limiter := e.limiter
+	e.muLimiter.Unlock()
+	return limiter.wait(ctx, n)
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// startWait calls the limiter's wait in a goroutine, and returns the
+// channel receiving its result.
+func startWait(ctx context.Context, l *rateLimiter, n int) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- l.wait(ctx, n)
+	}()
+	return done
+}
+
+// assertDone checks that the wait returned the expected error.
+func assertDone(t *testing.T, done <-chan error, expected error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if errors.Cause(err) != expected {
+			t.Fatalf("got %v, expected %v", err, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the wait did not return")
+	}
+}
+
+// assertWaiting checks that the wait is blocked on the clock for the
+// expected delay, leaving the clock just before the end of the delay.
+func assertWaiting(t *testing.T, clk *testclock.Clock, done <-chan error, delay time.Duration) {
+	t.Helper()
+	if err := clk.WaitAdvance(delay-time.Millisecond, 5*time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("the wait returned %v before %v", err, delay)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	clk := testclock.NewClock(time.Unix(0, 0))
+	l := newRateLimiter(clk, 10)
+	ctx := context.Background()
+	// the bucket is full initially.
+	assertDone(t, startWait(ctx, l, 10), nil)
+
+	done := startWait(ctx, l, 5)
+	assertWaiting(t, clk, done, 500*time.Millisecond)
+	clk.Advance(time.Millisecond)
+	assertDone(t, done, nil)
+}
+
+func TestRateLimiterLargeWrite(t *testing.T) {
+	clk := testclock.NewClock(time.Unix(0, 0))
+	l := newRateLimiter(clk, 10)
+	ctx := context.Background()
+	// writes larger than the bucket are allowed, and delay the
+	// following writes.
+	done := startWait(ctx, l, 25)
+	assertWaiting(t, clk, done, 1500*time.Millisecond)
+	clk.Advance(time.Millisecond)
+	assertDone(t, done, nil)
+
+	done = startWait(ctx, l, 10)
+	assertWaiting(t, clk, done, time.Second)
+	clk.Advance(time.Millisecond)
+	assertDone(t, done, nil)
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	clk := testclock.NewClock(time.Unix(0, 0))
+	l := newRateLimiter(clk, 10)
+	assertDone(t, startWait(context.Background(), l, 10), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startWait(ctx, l, 5)
+	<-clk.Alarms()
+	cancel()
+	assertDone(t, done, context.Canceled)
+
+	// the tokens of the canceled wait are given back, so that 5
+	// points can be written once the bucket refills for 500ms.
+	clk.Advance(500 * time.Millisecond)
+	assertDone(t, startWait(context.Background(), l, 5), nil)
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"context"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/errors"
+)
+
+const (
+	// selfTestMeasurement holds the name of the measurement the
+	// synthetic points of SelfTest are written to.
+	selfTestMeasurement = "metamorphosis_selftest"
+
+	// selfTestPingTimeout holds the time SelfTest waits for the
+	// influxdb server to respond to a ping.
+	selfTestPingTimeout = 5 * time.Second
+)
+
+// pinger is implemented by writers that can check whether the influxdb
+// server is reachable, e.g. the influxdb v1 client.Client.
+type pinger interface {
+	Ping(timeout time.Duration) (time.Duration, string, error)
+}
+
+// SelfTest checks that the topic config is valid and that the points of
+// the topic can be written using the writer, without waiting for kafka
+// messages. If the writer can ping the server it is pinged first, then a
+// synthetic point tagged with the topic name is written to the
+// metamorphosis_selftest measurement of the topic's database, named with
+// the exporter's measurement prefix and suffix, within the WriteTimeout
+// of the topic. In dry run mode the synthetic point is not written.
+//
+// SelfTest does not touch the measurements of the topic, nor the
+// exporter's statistics or counter state, so it is safe to run on
+// startup.
+func (e *Exporter) SelfTest(ctx context.Context, config TopicConfig, writer Writer) error {
+	if err := config.Validate(); err != nil {
+		return errors.Annotate(err, "invalid topic config")
+	}
+	if pinger, ok := writer.(pinger); ok {
+		if _, _, err := pinger.Ping(selfTestPingTimeout); err != nil {
+			return errors.Annotate(err, "failed to ping influxdb")
+		}
+	}
+	if e.DryRun {
+		return nil
+	}
+	p := e.newProcessor(&config)
+	bp, err := p.newBatchPoints()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	point, err := client.NewPoint(
+		p.measurementName(selfTestMeasurement),
+		map[string]string{"topic": config.Topic},
+		map[string]interface{}{"ok": true},
+		e.now(),
+	)
+	if err != nil {
+		return errors.Annotate(err, "failed to create the self-test point")
+	}
+	bp.AddPoint(point)
+	if err := e.writeBatch(ctx, p.timeoutWriter(writer), bp); err != nil {
+		return errors.Annotate(err, "failed to write the self-test point")
+	}
+	return nil
+}
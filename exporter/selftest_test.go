@@ -0,0 +1,116 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/clock/testclock"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+	"github.com/cloud-green/metamorphosis/exporter/exportertest"
+)
+
+// pingingWriter is a writer that can ping the server.
+type pingingWriter struct {
+	exportertest.RecordingWriter
+	pingErr error
+	pings   int
+}
+
+func (w *pingingWriter) Ping(timeout time.Duration) (time.Duration, string, error) {
+	w.pings++
+	return 0, "", w.pingErr
+}
+
+func TestSelfTest(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:    "cpu",
+		Fields:   map[string]string{"a": "number"},
+		Database: "metrics",
+	}
+	w := &pingingWriter{}
+	e := newExporter(t)
+	if err := e.SelfTest(context.Background(), config, w); err != nil {
+		t.Fatal(err)
+	}
+	if w.pings != 1 {
+		t.Errorf("got %d pings, expected 1", w.pings)
+	}
+	batches := w.BatchPoints()
+	if len(batches) != 1 || batches[0].Database() != "metrics" {
+		t.Fatalf("got %d batches, expected the synthetic point in the topic's database", len(batches))
+	}
+	m := exportertest.PointMatcher{
+		Measurement: "metamorphosis_selftest",
+		Tags:        map[string]string{"topic": "cpu"},
+		Fields:      map[string]interface{}{"ok": true},
+	}
+	if err := m.Match(batches[0].Points()[0]); err != nil {
+		t.Error(err)
+	}
+	if stats := e.Stats(); len(stats) != 0 {
+		t.Errorf("got stats %v after the self test", stats)
+	}
+}
+
+func TestSelfTestExporterSettings(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	e := &exporter.Exporter{
+		Logger:            testLogger{t},
+		Clock:             testclock.NewClock(epoch),
+		MeasurementPrefix: "test_",
+		MeasurementSuffix: "_v1",
+	}
+	w := &pingingWriter{}
+	if err := e.SelfTest(context.Background(), config, w); err != nil {
+		t.Fatal(err)
+	}
+	// the point is named and timed as the points of ProcessData.
+	assertLines(t, lines(w.Points()), "test_metamorphosis_selftest_v1,topic=cpu ok=true 1000000000")
+}
+
+func TestSelfTestErrors(t *testing.T) {
+	ctx := context.Background()
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+	}
+	invalid := config
+	invalid.Precision = "m"
+	w := &pingingWriter{}
+	err := newExporter(t).SelfTest(ctx, invalid, w)
+	if err == nil || !strings.Contains(err.Error(), "invalid topic config") {
+		t.Errorf("got %v, expected a config error", err)
+	}
+	if w.pings != 0 || len(w.Points()) != 0 {
+		t.Errorf("the writer is used with an invalid config")
+	}
+
+	w = &pingingWriter{pingErr: errors.New("connection refused")}
+	err = newExporter(t).SelfTest(ctx, config, w)
+	if err == nil || !strings.Contains(err.Error(), "failed to ping influxdb") {
+		t.Errorf("got %v, expected a ping error", err)
+	}
+
+	w = &pingingWriter{}
+	w.Err = errors.New("database not found")
+	err = newExporter(t).SelfTest(ctx, config, w)
+	if err == nil || !strings.Contains(err.Error(), "failed to write the self-test point") {
+		t.Errorf("got %v, expected a write error", err)
+	}
+
+	slow := config
+	slow.WriteTimeout = 10 * time.Millisecond
+	err = newExporter(t).SelfTest(ctx, slow, &fakeWriter{delay: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "write timed out after 10ms") {
+		t.Errorf("got %v, expected a timeout error", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+func TestSummary(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:    "latency",
+		Type:     "summary",
+		ValueKey: "samples",
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"samples": [4, 1, 3, 2]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "latency count=4i,max=4,mean=2.5,min=1 1000000000")
+
+	config.ValueKey = "latency.samples"
+	got, err = buildPoints(t, newExporter(t), config, `{"latency": {"samples": [5, 7]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "latency count=2i,max=7,mean=6,min=5 1000000000")
+}
+
+func TestSummaryNoSamples(t *testing.T) {
+	logger := &logRecorder{}
+	config := exporter.TopicConfig{
+		Topic:    "latency",
+		Type:     "summary",
+		ValueKey: "samples",
+	}
+	got, err := buildPoints(t, &exporter.Exporter{Logger: logger}, config, `{"samples": []}`, `{"samples": [5]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "latency count=1i,max=5,mean=5,min=5 1000000000")
+	if !logger.contains("no samples") {
+		t.Errorf("the empty samples are not logged: %q", logger.msgs)
+	}
+}
+
+// referencePercentile returns the percentile of the samples, computed as
+// the weighted mean of the two samples closest to the percentile's rank
+// in the sorted samples.
+func referencePercentile(samples []float64, percentile float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	rank := percentile / 100 * float64(len(sorted)-1)
+	i := int(rank)
+	if i == len(sorted)-1 {
+		return sorted[i]
+	}
+	weight := rank - float64(i)
+	return (1-weight)*sorted[i] + weight*sorted[i+1]
+}
+
+func TestSummaryPercentiles(t *testing.T) {
+	samples := []float64{15, 1, 7, 3, 40, 2, 9, 11, 4, 100}
+	config := exporter.TopicConfig{
+		Topic:       "latency",
+		Type:        "summary",
+		ValueKey:    "samples",
+		Percentiles: []float64{50, 95, 99, 99.9, 100, 12.5},
+	}
+	data := `{"samples": [`
+	for i, sample := range samples {
+		if i > 0 {
+			data += ", "
+		}
+		data += strconv.FormatFloat(sample, 'f', -1, 64)
+	}
+	data += "]}"
+	bp, err := newExporter(t).BuildPoints(config, entries(data), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := bp.Points()[0].Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, percentile := range config.Percentiles {
+		name := "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+		got, ok := fields[name].(float64)
+		if !ok {
+			t.Errorf("field %q not written, got fields %v", name, fields)
+			continue
+		}
+		if expected := referencePercentile(samples, percentile); math.Abs(got-expected) > 1e-9 {
+			t.Errorf("got %s=%v, expected %v", name, got, expected)
+		}
+	}
+	if fields["p50"] != 8.0 {
+		t.Errorf("got median %v, expected 8", fields["p50"])
+	}
+}
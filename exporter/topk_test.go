@@ -0,0 +1,64 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"testing"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+func TestTopK(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "top",
+		Fields: map[string]string{"k": "top-k"},
+		K:      2,
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"k": {"a": 1, "b": 20, "c": 5}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "top b=20,c=5 1000000000")
+
+	config.OtherField = "other"
+	got, err = buildPoints(t, newExporter(t), config, `{"k": {"a": 1, "b": 20, "c": 5, "d": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "top b=20,c=5,other=3 1000000000")
+}
+
+func TestTopKItems(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "top",
+		Fields: map[string]string{"k": "top-k"},
+		K:      10,
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"k": [{"name": "a", "count": 1}, {"name": "b", "count": 20}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "top a=1,b=20 1000000000")
+
+	config.LabelKey = "label"
+	config.CountKey = "n"
+	got, err = buildPoints(t, newExporter(t), config, `{"k": [{"label": "a", "n": 1}, {"label": "b", "n": 20}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "top a=1,b=20 1000000000")
+}
+
+func TestTopKMinValue(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:    "top",
+		Fields:   map[string]string{"k": "top-k"},
+		K:        10,
+		MinValue: 2,
+	}
+	got, err := buildPoints(t, newExporter(t), config, `{"k": {"a": 1, "b": 20, "c": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, got, "top b=20,c=2 1000000000")
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+)
+
+// sequence returns a Rand function returning the given numbers in
+// turn, then 0.
+func sequence(numbers ...float64) func() float64 {
+	return func() float64 {
+		if len(numbers) == 0 {
+			return 0
+		}
+		n := numbers[0]
+		numbers = numbers[1:]
+		return n
+	}
+}
+
+func TestTraceTagSampled(t *testing.T) {
+	e := newExporter(t)
+	e.Rand = sequence(0.1, 0.9, 0.4)
+	config := exporter.TopicConfig{
+		Topic:           "cpu",
+		Fields:          map[string]string{"a": "number"},
+		TraceTagField:   "trace",
+		TraceSampleRate: 0.5,
+	}
+	w, err := processData(t, e, config,
+		`{"a": 1, "trace": "x"}`,
+		`{"a": 2, "trace": "y"}`,
+		`{"a": 3, "trace": "z"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()),
+		"cpu,trace=x a=1 1000000000",
+		"cpu a=2 1000000000",
+		"cpu,trace=z a=3 1000000000",
+	)
+}
+
+func TestTraceTagSampleRate(t *testing.T) {
+	e := newExporter(t)
+	e.Rand = sequence(0.1, 0.9, 0.4)
+	config := exporter.TopicConfig{
+		Topic:         "cpu",
+		Fields:        map[string]string{"a": "number"},
+		TraceTagField: "trace",
+		SampleRate:    0.5,
+	}
+	w, err := processData(t, e, config,
+		`{"a": 1, "trace": "x"}`,
+		`{"a": 2, "trace": "y"}`,
+		`{"a": 3, "trace": "z"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the points of all the entries selected by the sample rate hold
+	// the trace tag.
+	assertLines(t, lines(w.Points()),
+		"cpu,trace=x a=1 1000000000",
+		"cpu,trace=z a=3 1000000000",
+	)
+}
+
+func TestTraceTagNotSampled(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:         "cpu",
+		Fields:        map[string]string{"a": "number"},
+		TraceTagField: "trace",
+	}
+	w, err := processData(t, newExporter(t), config, `{"a": 1, "trace": "x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "cpu a=1 1000000000")
+}
+
+func TestTraceTagCounter(t *testing.T) {
+	e := newExporter(t)
+	e.Rand = sequence(0.1, 0.9, 0.1)
+	config := exporter.TopicConfig{
+		Topic:           "cpu",
+		Type:            "counter",
+		TraceTagField:   "trace",
+		TraceSampleRate: 0.5,
+	}
+	w, err := processData(t, e, config,
+		`{"value": 1, "trace": "a"}`,
+		`{"value": 5, "trace": "b"}`,
+		`{"value": 9, "trace": "c"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the trace tag does not change the series of the counter.
+	assertLines(t, lines(w.Points()),
+		"cpu value=4 1000000000",
+		"cpu,trace=c value=4 1000000000",
+	)
+}
+
+func TestTraceTagSet(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:           "users",
+		Type:            "set",
+		TraceTagField:   "trace",
+		TraceSampleRate: 1,
+	}
+	w, err := processData(t, newExporter(t), config,
+		`{"value": "x", "trace": "a"}`,
+		`{"value": "y", "trace": "b"}`,
+		`{"value": "x", "trace": "c"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "users value=2i 1000000000")
+}
+
+func TestTraceTagMergeBuckets(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic: "cpu",
+		Fields: map[string]string{
+			"a": "number?",
+			"b": "number?",
+		},
+		TimeBucket:      time.Minute,
+		MergeBuckets:    true,
+		TraceTagField:   "trace",
+		TraceSampleRate: 1,
+	}
+	w, err := processData(t, newExporter(t), config,
+		`{"a": 1, "trace": "x"}`,
+		`{"b": 2, "trace": "y"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "cpu,trace=y a=1,b=2 0")
+}
@@ -0,0 +1,383 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// Writer is the interface used by the exporter to write batches of
+// points. The influxdb v1 client.Client implements it.
+type Writer interface {
+	// Write writes the batch of points.
+	Write(client.BatchPoints) error
+}
+
+// ClientFactory provides the writers used for the influxdb endpoints of
+// the topics. A writer is created once per endpoint and reused for all
+// topics written to that endpoint.
+type ClientFactory struct {
+	// Default holds the writer used for topics that do not specify
+	// an endpoint.
+	Default Writer
+	// New creates a writer for the endpoint.
+	New func(endpoint string) (Writer, error)
+
+	mu      sync.Mutex
+	writers map[string]Writer
+}
+
+// Writer returns the writer for the endpoint, creating it if needed.
+func (f *ClientFactory) Writer(endpoint string) (Writer, error) {
+	if endpoint == "" {
+		return f.Default, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if writer, ok := f.writers[endpoint]; ok {
+		return writer, nil
+	}
+	if f.New == nil {
+		return nil, errors.Errorf("cannot create a writer for endpoint %q", endpoint)
+	}
+	writer, err := f.New(endpoint)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f.writers == nil {
+		f.writers = make(map[string]Writer)
+	}
+	f.writers[endpoint] = writer
+	return writer, nil
+}
+
+// Close closes the writers created by the factory. The default writer is
+// not closed.
+func (f *ClientFactory) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var firstErr error
+	for endpoint, writer := range f.writers {
+		if closer, ok := writer.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = errors.Annotatef(err, "failed to close writer for endpoint %q", endpoint)
+			}
+		}
+		delete(f.writers, endpoint)
+	}
+	return firstErr
+}
+
+// DiscardWriter is a writer discarding all points. It is used in dry run
+// mode, so that no connection to a server is made.
+var DiscardWriter Writer = discardWriter{}
+
+type discardWriter struct{}
+
+// Write implements Writer.
+func (discardWriter) Write(client.BatchPoints) error {
+	return nil
+}
+
+// MultiWriter returns a writer writing each batch of points using all
+// the writers concurrently. A failed write does not prevent the others:
+// if any of the writes fail, an error holding all the failures is
+// returned once all the writes have completed.
+func MultiWriter(writers ...Writer) Writer {
+	return multiWriter(writers)
+}
+
+type multiWriter []Writer
+
+// Write implements Writer.
+func (w multiWriter) Write(bp client.BatchPoints) error {
+	errs := make([]error, len(w))
+	var wg sync.WaitGroup
+	for i, writer := range w {
+		wg.Add(1)
+		go func(i int, writer Writer) {
+			defer wg.Done()
+			errs[i] = writer.Write(bp)
+		}(i, writer)
+	}
+	wg.Wait()
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("writer %d: %v", i, err))
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.Errorf("failed to write using %d of %d writers: %s", len(msgs), len(w), strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// Close closes the writers implementing io.Closer.
+func (w multiWriter) Close() error {
+	var firstErr error
+	for _, writer := range w {
+		if closer, ok := writer.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = errors.Trace(err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// write writes the points using the writer in batches of at most BatchSize
+// points. The writer is not used if there are no points.
+func (p *processor) write(ctx context.Context, writer Writer, points []*client.Point) error {
+	writer = &latencyWriter{
+		writer: p.timeoutWriter(writer),
+		clock:  p.exporter.clock(),
+		stats:  &p.stats,
+	}
+	for len(points) > 0 {
+		n := len(points)
+		if p.exporter.BatchSize > 0 && n > p.exporter.BatchSize {
+			n = p.exporter.BatchSize
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		default:
+		}
+		bp, err := p.newBatchPoints()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bp.AddPoints(points[:n])
+		if p.exporter.DryRun {
+			for _, point := range bp.Points() {
+				p.logf("dry run: %s", point.PrecisionString(bp.Precision()))
+			}
+		} else {
+			if err := p.exporter.waitRateLimit(ctx, n); err != nil {
+				return errors.Trace(err)
+			}
+			written, err := p.exporter.writePoints(ctx, writer, bp)
+			if err != nil {
+				return errors.Annotate(err, "failed to send a batch of points")
+			}
+			p.stats.PointsWritten += int64(written)
+		}
+		points = points[n:]
+	}
+	return nil
+}
+
+// timeoutWriter returns the writer, failing writes that exceed the
+// WriteTimeout of the topic, if set.
+func (p *processor) timeoutWriter(writer Writer) Writer {
+	if p.WriteTimeout > 0 {
+		return &timeoutWriter{
+			writer:  writer,
+			timeout: p.WriteTimeout,
+		}
+	}
+	return writer
+}
+
+// latencyWriter is a writer recording the durations of the writes in
+// the topic statistics.
+type latencyWriter struct {
+	writer Writer
+	clock  clock.Clock
+	stats  *TopicStats
+}
+
+// Write implements Writer.
+func (w *latencyWriter) Write(bp client.BatchPoints) error {
+	start := w.clock.Now()
+	err := w.writer.Write(bp)
+	if err != nil {
+		w.stats.FailedWriteLatency.observe(w.clock.Now().Sub(start))
+	} else {
+		w.stats.WriteLatency.observe(w.clock.Now().Sub(start))
+	}
+	return err
+}
+
+// timeoutWriter is a writer failing writes that do not complete within
+// the timeout. The influxdb v1 client does not support contexts, so a
+// write that timed out keeps running in the background until the
+// client's own timeout is reached.
+type timeoutWriter struct {
+	writer  Writer
+	timeout time.Duration
+}
+
+// Write implements Writer.
+func (w *timeoutWriter) Write(bp client.BatchPoints) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- w.writer.Write(bp)
+	}()
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errors.Errorf("write timed out after %v", w.timeout)
+	}
+}
+
+// writePoints writes the batch of points using the writer. Points
+// rejected by influxdb because of a field type conflict are dropped and
+// the remaining points are written again. The number of written points
+// is returned.
+func (e *Exporter) writePoints(ctx context.Context, writer Writer, bp client.BatchPoints) (int, error) {
+	for {
+		err := e.writeBatch(ctx, writer, bp)
+		if err == nil {
+			return len(bp.Points()), nil
+		}
+		conflict, ok := parseFieldTypeConflict(err)
+		if !ok {
+			return 0, errors.Trace(err)
+		}
+		remaining, err := e.dropConflictingPoints(bp, conflict)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if len(remaining.Points()) == len(bp.Points()) {
+			// none of the points caused the conflict
+			return 0, errors.Errorf("failed to resolve %v", conflict)
+		}
+		bp = remaining
+		if len(bp.Points()) == 0 {
+			return 0, nil
+		}
+	}
+}
+
+// fieldTypeConflict describes a field type conflict reported by
+// influxdb: the field of the measurement was written with a type
+// different from the type of the existing field.
+type fieldTypeConflict struct {
+	field       string
+	measurement string
+	fieldType   string
+}
+
+func (c fieldTypeConflict) String() string {
+	return fmt.Sprintf("field type conflict on field %q of measurement %q of type %s", c.field, c.measurement, c.fieldType)
+}
+
+var fieldTypeConflictRE = regexp.MustCompile(`field type conflict: input field "([^"]*)" on measurement "([^"]*)" is type (\w+)`)
+
+// parseFieldTypeConflict returns the field type conflict described by the
+// write error.
+func parseFieldTypeConflict(err error) (fieldTypeConflict, bool) {
+	m := fieldTypeConflictRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fieldTypeConflict{}, false
+	}
+	return fieldTypeConflict{
+		field:       m[1],
+		measurement: m[2],
+		fieldType:   m[3],
+	}, true
+}
+
+// dropConflictingPoints returns a copy of the batch of points without the
+// points causing the field type conflict.
+func (e *Exporter) dropConflictingPoints(bp client.BatchPoints, conflict fieldTypeConflict) (client.BatchPoints, error) {
+	remaining, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:         bp.Database(),
+		RetentionPolicy:  bp.RetentionPolicy(),
+		Precision:        bp.Precision(),
+		WriteConsistency: bp.WriteConsistency(),
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, point := range bp.Points() {
+		if point.Name() == conflict.measurement {
+			fields, err := point.Fields()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if value, ok := fields[conflict.field]; ok && fieldType(value) == conflict.fieldType {
+				e.logf("dropping point with conflicting field type: %v", point)
+				continue
+			}
+		}
+		remaining.AddPoint(point)
+	}
+	return remaining, nil
+}
+
+// fieldType returns the influxdb type of the field value.
+func fieldType(value interface{}) string {
+	switch value.(type) {
+	case float64:
+		return "float"
+	case int64:
+		return "integer"
+	case uint64:
+		return "unsigned"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	}
+	return ""
+}
+
+// writeBatch writes the batch of points using the writer, retrying
+// failed writes as specified by the retry config. Permanent errors,
+// e.g. field type conflicts, are not retried. The backoff between the
+// attempts is waited on the exporter clock.
+func (e *Exporter) writeBatch(ctx context.Context, writer Writer, bp client.BatchPoints) error {
+	backoff := e.Retry.InitialBackoff
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+	multiplier := e.Retry.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	for attempt := 1; ; attempt++ {
+		err := writer.Write(bp)
+		if err == nil {
+			return nil
+		}
+		if attempt >= e.Retry.MaxAttempts || isPermanentWriteError(err) {
+			return errors.Trace(err)
+		}
+		e.logf("failed to write a batch of points, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-e.clock().After(backoff):
+		}
+		backoff = time.Duration(float64(backoff) * multiplier)
+	}
+}
+
+// isPermanentWriteError returns true if the write was rejected by the
+// server with a 4xx status, because of the written points or the
+// request, and so will not succeed when retried. Network errors and 5xx
+// statuses are retried, as is 429 Too Many Requests.
+func isPermanentWriteError(err error) bool {
+	werr, ok := errors.Cause(err).(*WriteError)
+	if !ok {
+		return false
+	}
+	return werr.StatusCode/100 == 4 && werr.StatusCode != http.StatusTooManyRequests
+}
@@ -0,0 +1,443 @@
+// Copyright 2019 Canonical Ltd.  All rights reserved.
+
+package exporter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/juju/clock/testclock"
+	jujuerrors "github.com/juju/errors"
+
+	"github.com/cloud-green/metamorphosis/exporter"
+	"github.com/cloud-green/metamorphosis/exporter/exportertest"
+)
+
+// fakeWriter is a writer recording the written batches of points, whose
+// writes first fail with the queued errors. Each write takes at least
+// the delay.
+type fakeWriter struct {
+	exportertest.RecordingWriter
+
+	mu     sync.Mutex
+	errs   []error
+	delay  time.Duration
+	writes int
+}
+
+// Write implements exporter.Writer.
+func (w *fakeWriter) Write(bp client.BatchPoints) error {
+	w.mu.Lock()
+	w.writes++
+	var err error
+	if len(w.errs) > 0 {
+		err, w.errs = w.errs[0], w.errs[1:]
+	}
+	w.mu.Unlock()
+	time.Sleep(w.delay)
+	if err != nil {
+		return err
+	}
+	return w.RecordingWriter.Write(bp)
+}
+
+// numberEntries returns n JSON entries holding the "a" numbers from 1
+// to n.
+func numberEntries(n int) [][]byte {
+	data := make([][]byte, n)
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf(`{"a": %d}`, i+1))
+	}
+	return data
+}
+
+var numberConfig = exporter.TopicConfig{
+	Topic:  "cpu",
+	Fields: map[string]string{"a": "number"},
+}
+
+func TestBatchSize(t *testing.T) {
+	e := newExporter(t)
+	e.BatchSize = 5
+	w := &fakeWriter{}
+	err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(12), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, bp := range w.BatchPoints() {
+		sizes = append(sizes, len(bp.Points()))
+	}
+	if fmt.Sprint(sizes) != "[5 5 2]" {
+		t.Errorf("got batches of %v points, expected [5 5 2]", sizes)
+	}
+	if n := len(w.Points()); n != 12 {
+		t.Errorf("got %d points, expected 12", n)
+	}
+}
+
+func TestNoPoints(t *testing.T) {
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number"},
+		Filter: &exporter.FilterConfig{
+			Key:    "env",
+			Values: []string{"prod"},
+		},
+	}
+	w := &fakeWriter{}
+	err := newExporter(t).ProcessData(context.Background(), config, w, entries(`{"env": "dev", "a": 1}`, `{"env": "dev", "a": 2}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 0 {
+		t.Errorf("got %d writes of filtered entries, expected none", w.writes)
+	}
+
+	// the processing errors are still returned.
+	err = newExporter(t).ProcessData(context.Background(), config, w, entries(`{`), []time.Time{epoch})
+	if !errors.Is(err, exporter.ErrUnmarshal) {
+		t.Errorf("got %v, expected an unmarshal error", err)
+	}
+	if w.writes != 0 {
+		t.Errorf("got %d writes of invalid entries, expected none", w.writes)
+	}
+}
+
+func TestClientWriter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		bodies = append(bodies, req.URL.Path+"?"+req.URL.RawQuery+" "+string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	// the influxdb v1 clients are writers.
+	c, err := client.NewHTTPClient(client.HTTPConfig{Addr: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = newExporter(t).ProcessData(context.Background(), numberConfig, c, numberEntries(1), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 || bodies[0] != "/write?consistency=&db=kpi&precision=ms&rp= cpu a=1 1000\n" {
+		t.Errorf("got requests %q", bodies)
+	}
+}
+
+// processDataRetried processes the data, advancing the clock by each of
+// the backoffs the exporter waits for between the write attempts.
+func processDataRetried(t *testing.T, e *exporter.Exporter, clk *testclock.Clock, w exporter.Writer, backoffs ...time.Duration) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- e.ProcessData(context.Background(), numberConfig, w, numberEntries(1), []time.Time{epoch})
+	}()
+	for _, backoff := range backoffs {
+		if err := clk.WaitAdvance(backoff, 5*time.Second, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the data was not processed")
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	clk := testclock.NewClock(epoch)
+	e := newExporter(t)
+	e.Clock = clk
+	e.Retry = exporter.RetryConfig{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+	}
+	// network errors and 5xx statuses are retried, the backoff
+	// doubling after each attempt.
+	w := &fakeWriter{
+		errs: []error{
+			errors.New("connection refused"),
+			&exporter.WriteError{StatusCode: http.StatusServiceUnavailable, Message: "service unavailable"},
+		},
+	}
+	if err := processDataRetried(t, e, clk, w, time.Second, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 3 {
+		t.Errorf("got %d writes, expected 3", w.writes)
+	}
+	assertLines(t, lines(w.Points()), "cpu a=1 1000000000")
+
+	// the write fails once the attempts are exhausted.
+	w = &fakeWriter{
+		errs: []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")},
+	}
+	err := processDataRetried(t, e, clk, w, time.Second, 2*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("got %v, expected the write error", err)
+	}
+	if w.writes != 3 {
+		t.Errorf("got %d writes, expected 3", w.writes)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	e := newExporter(t)
+	e.Retry = exporter.RetryConfig{
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+	}
+	config := numberConfig
+	config.WriteTimeout = 10 * time.Millisecond
+	w := &fakeWriter{delay: time.Second}
+	start := time.Now()
+	err := e.ProcessData(context.Background(), config, w, numberEntries(1), []time.Time{epoch})
+	if err == nil || !strings.Contains(err.Error(), "write timed out after 10ms") {
+		t.Errorf("got %v, expected a timeout error", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("the write returned after %v, expected the timeout", d)
+	}
+	// timed out writes are retried.
+	w.mu.Lock()
+	writes := w.writes
+	w.mu.Unlock()
+	if writes != 2 {
+		t.Errorf("got %d writes, expected 2", writes)
+	}
+
+	w = &fakeWriter{delay: time.Millisecond}
+	config.WriteTimeout = time.Second
+	if err := e.ProcessData(context.Background(), config, w, numberEntries(1), []time.Time{epoch}); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, lines(w.Points()), "cpu a=1 1000000000")
+}
+
+func TestWriteLatency(t *testing.T) {
+	e := newExporter(t)
+	w := &fakeWriter{delay: 20 * time.Millisecond}
+	if err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(1), []time.Time{epoch}); err != nil {
+		t.Fatal(err)
+	}
+	w.errs = []error{errors.New("connection refused")}
+	if err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(1), []time.Time{epoch}); err == nil {
+		t.Fatal("expected an error")
+	}
+	stats := e.Stats()["cpu"]
+	for about, h := range map[string]exporter.LatencyHistogram{
+		"successful": stats.WriteLatency,
+		"failed":     stats.FailedWriteLatency,
+	} {
+		if h.Count != 1 || h.Sum < 20*time.Millisecond {
+			t.Errorf("got %s write latency %+v, expected a single write of at least 20ms", about, h)
+		}
+		if h.Counts[0] != 0 || h.Counts[1]+h.Counts[2]+h.Counts[3] != 1 {
+			t.Errorf("got %s write latency buckets %v", about, h.Counts)
+		}
+	}
+}
+
+func TestRetryPermanentError(t *testing.T) {
+	e := newExporter(t)
+	e.Retry = exporter.RetryConfig{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	}
+	w := &fakeWriter{
+		errs: []error{&exporter.WriteError{StatusCode: http.StatusNotFound, Message: `database not found: "kpi"`}},
+	}
+	err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(1), []time.Time{epoch})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if w.writes != 1 {
+		t.Errorf("got %d writes, expected 1", w.writes)
+	}
+
+	// the statuses are told apart through the errors annotating them.
+	w = &fakeWriter{
+		errs: []error{jujuerrors.Annotate(&exporter.WriteError{StatusCode: http.StatusBadRequest, Message: "unable to parse"}, "write failed")},
+	}
+	if err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(1), []time.Time{epoch}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if w.writes != 1 {
+		t.Errorf("got %d writes, expected 1", w.writes)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	logger := &logRecorder{}
+	e := &exporter.Exporter{
+		DryRun: true,
+		Logger: logger,
+	}
+	w := &fakeWriter{}
+	err := e.ProcessData(context.Background(), numberConfig, w, numberEntries(1), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 0 {
+		t.Errorf("got %d writes in dry run mode", w.writes)
+	}
+	if !logger.contains("dry run: cpu a=1 1000") {
+		t.Errorf("the point was not logged: %q", logger.msgs)
+	}
+}
+
+func TestFieldTypeConflict(t *testing.T) {
+	// the first write is rejected as influxdb 1.x does.
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"partial write: field type conflict: input field \"a\" on measurement \"cpu\" is type float, already exists as type string dropped=1"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	c, err := exporter.NewInfluxDBClient(client.HTTPConfig{Addr: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	config := exporter.TopicConfig{
+		Topic:  "cpu",
+		Fields: map[string]string{"a": "number?", "b": "number?"},
+	}
+	err = newExporter(t).ProcessData(context.Background(), config, c, entries(`{"b": 1}`, `{"a": 2}`, `{"b": 3}`), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Fatalf("got %d writes, expected 2", len(bodies))
+	}
+	// only the point causing the conflict is dropped.
+	if bodies[1] != "cpu b=1 1000\ncpu b=3 1000\n" {
+		t.Errorf("got body %q", bodies[1])
+	}
+}
+
+func TestMultiWriter(t *testing.T) {
+	w1, w2 := &fakeWriter{}, &fakeWriter{}
+	w := exporter.MultiWriter(w1, w2)
+	if err := newExporter(t).ProcessData(context.Background(), numberConfig, w, numberEntries(2), []time.Time{epoch}); err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range []*fakeWriter{w1, w2} {
+		assertLines(t, lines(w.Points()), "cpu a=1 1000000000", "cpu a=2 1000000000")
+		if w.writes != 1 {
+			t.Errorf("writer %d got %d writes, expected 1", i, w.writes)
+		}
+	}
+
+	// a failed write does not prevent the other writes.
+	w1, w2 = &fakeWriter{errs: []error{errors.New("connection refused")}}, &fakeWriter{}
+	bp, err := newExporter(t).BuildPoints(numberConfig, numberEntries(1), []time.Time{epoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exporter.MultiWriter(w1, w2).Write(bp)
+	if err == nil || err.Error() != "failed to write using 1 of 2 writers: writer 0: connection refused" {
+		t.Errorf("got %v, expected the error of the first writer", err)
+	}
+	assertLines(t, lines(w2.Points()), "cpu a=1 1000000000")
+}
+
+func TestMultiWriterClose(t *testing.T) {
+	w1, w2 := &closingWriter{}, &closingWriter{}
+	w := exporter.MultiWriter(w1, &fakeWriter{}, w2)
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !w1.closed || !w2.closed {
+		t.Error("the writers are not closed")
+	}
+}
+
+// closingWriter is a writer recording whether it was closed.
+type closingWriter struct {
+	exportertest.RecordingWriter
+	endpoint string
+	closed   bool
+}
+
+func (w *closingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestClientFactory(t *testing.T) {
+	var created []*closingWriter
+	defaultWriter := &closingWriter{}
+	f := &exporter.ClientFactory{
+		Default: defaultWriter,
+		New: func(endpoint string) (exporter.Writer, error) {
+			w := &closingWriter{endpoint: endpoint}
+			created = append(created, w)
+			return w, nil
+		},
+	}
+	writer := func(endpoint string) exporter.Writer {
+		w, err := f.Writer(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	if writer("") != defaultWriter {
+		t.Errorf("the default writer is not used without an endpoint")
+	}
+	a, b := writer("a:8086"), writer("b:8086")
+	if a == b {
+		t.Errorf("got the same writer for distinct endpoints")
+	}
+	if writer("a:8086") != a {
+		t.Errorf("the writer of an endpoint is not reused")
+	}
+	if len(created) != 2 {
+		t.Errorf("got %d writers created, expected 2", len(created))
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range created {
+		if !w.closed {
+			t.Errorf("the writer of %q is not closed", w.endpoint)
+		}
+	}
+	if defaultWriter.closed {
+		t.Errorf("the default writer is closed")
+	}
+}
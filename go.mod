@@ -1,9 +1,10 @@
 module github.com/cloud-green/metamorphosis
 
-go 1.12
+go 1.13
 
 require (
 	github.com/Shopify/sarama v1.21.0
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/influxdata/influxdb1-client v0.0.0-20190124185755-16c852ea613f
 	github.com/juju/clock v0.0.0-20190205081909-9c5c9712527c
 	github.com/juju/errors v0.0.0-20190207033735-e65537c515d7
@@ -14,8 +15,9 @@ require (
 	github.com/juju/zaputil v0.0.0-20190326175239-ef53049637ac
 	go.uber.org/zap v1.9.1
 	golang.org/x/crypto v0.0.0-20190422183909-d864b10871cd // indirect
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce // indirect
 	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637
 	gopkg.in/yaml.v1 v1.0.0-20140924161607-9f9df34309c0
-	gopkg.in/yaml.v2 v2.2.2 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )